@@ -0,0 +1,198 @@
+// Backtest the strategy on recorded trades
+
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/paper"
+	"bitmm/recorder"
+	"bitmm/risk"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grd/stat"
+)
+
+// Seconds of trade time between equity samples for the Sharpe ratio
+const sampleInterval = 3600
+
+// Results of a backtest
+type backtestResult struct {
+	Trades      int     // Market trades replayed
+	Fills       int     // Simulated executions of our orders
+	Realized    float64 // Realized P&L
+	Unrealized  float64 // P&L of the final position at the last trade price
+	MaxDrawdown float64 // Largest fall in P&L from a previous high
+	Sharpe      float64 // Mean over standard deviation of hourly P&L changes
+	MaxLong     float64 // Largest long position
+	MaxShort    float64 // Largest short position, negative
+	MeanAbsPos  float64 // Average absolute position after each quoted trade
+	Flat        float64 // Fraction of quoted trades with no position
+	Position    float64 // Final position
+}
+
+// replay serves recorded trades up to the current one, newest first
+type replay struct {
+	trades bitfinex.Trades // Oldest first
+	n      int             // Number of trades released so far
+}
+
+// TradesContext returns up to limitTrades of the released trades, newest first
+func (r *replay) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	trades := make(bitfinex.Trades, 0, limitTrades)
+	for i := r.n - 1; i >= 0 && len(trades) < limitTrades; i-- {
+		trades = append(trades, r.trades[i])
+	}
+
+	return trades, nil
+}
+
+// OrderbookContext returns an empty book, only trades are recorded
+func (r *replay) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	return bitfinex.Book{}, nil
+}
+
+// Run a backtest on the trades files at paths and print the results
+func runBacktest(paths []string) error {
+	var trades bitfinex.Trades
+	for _, path := range paths {
+		f, err := recorder.Open(path)
+		if err != nil {
+			return err
+		}
+		trades, err = readTrades(f, trades)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	r := backtest(trades)
+
+	fmt.Printf("\nTrades:       %d\n", r.Trades)
+	fmt.Printf("Fills:        %d\n", r.Fills)
+	fmt.Printf("P&L:          %.4f (%.4f realized, %.4f unrealized)\n", r.Realized+r.Unrealized, r.Realized, r.Unrealized)
+	fmt.Printf("Max drawdown: %.4f\n", r.MaxDrawdown)
+	fmt.Printf("Sharpe:       %.4f (hourly)\n", r.Sharpe)
+	fmt.Printf("Position:     %.2f final, %.2f max long, %.2f max short\n", r.Position, r.MaxLong, r.MaxShort)
+	fmt.Printf("Inventory:    %.2f mean absolute, %.1f%% flat\n", r.MeanAbsPos, 100*r.Flat)
+
+	return nil
+}
+
+// Read trades, one JSON trade or recorded trade per line, adding them to
+// trades sorted oldest first without duplicates. Other recorded data is
+// skipped, and a recording cut short by a killed recorder is used up to where
+// it ends.
+func readTrades(r io.Reader, trades bitfinex.Trades) (bitfinex.Trades, error) {
+	err := recorder.Read(r, func(record recorder.Record) error {
+		if record.Trade != nil {
+			trades = append(trades, *record.Trade)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Reconnections repeat recent trades
+	sort.SliceStable(trades, func(i, j int) bool { return trades[i].TID < trades[j].TID })
+	unique := trades[:0]
+	for _, trade := range trades {
+		if len(unique) == 0 || trade.TID != unique[len(unique)-1].TID {
+			unique = append(unique, trade)
+		}
+	}
+
+	return unique, nil
+}
+
+// Replay trades through the strategy, quoting on a paper account after each
+// trade once there are enough for the calculations
+func backtest(trades bitfinex.Trades) backtestResult {
+	market := &replay{trades: trades}
+	account := paper.New(market, cfg.Sec.PaperBalance)
+	preTrade = risk.NewPreTrade(orderLimits())
+	resetLoop(account)
+	positionChan := make(chan float64)
+
+	var (
+		r                        backtestResult
+		peak, lastSample, absPos float64
+		sampleTime, flat, steps  int
+		samples                  stat.Float64Slice
+	)
+	for market.n < len(trades) {
+		market.n++
+		recent := getTrades()
+		drainFills(account, &r)
+		if len(recent) < cfg.Sec.TradeNum || len(recent) < 2 {
+			continue
+		}
+
+		go checkPosition(positionChan)
+		theo := calculateTheo(recent)
+		stdev := calculateStdev(recent)
+		position := <-positionChan
+		if !apiErrors && needOrders(theo, position) {
+			sendOrders(theo, position, stdev, recent[0].Price, time.Unix(int64(recent[0].Timestamp), 0))
+		}
+		apiErrors = false
+
+		// Statistics
+		steps++
+		r.Position = position
+		r.MaxLong = math.Max(r.MaxLong, position)
+		r.MaxShort = math.Min(r.MaxShort, position)
+		absPos += math.Abs(position)
+		if math.Abs(position) < cfg.Sec.MinPos {
+			flat++
+		}
+		realized, unrealized := account.PL()
+		pl := realized + unrealized
+		peak = math.Max(peak, pl)
+		r.MaxDrawdown = math.Max(r.MaxDrawdown, peak-pl)
+		if now := recent[0].Timestamp; sampleTime == 0 {
+			sampleTime = now
+		} else if now-sampleTime >= sampleInterval {
+			samples = append(samples, pl-lastSample)
+			lastSample, sampleTime = pl, now
+		}
+	}
+	cancelAll()
+	drainFills(account, &r)
+
+	r.Trades = len(trades)
+	r.Realized, r.Unrealized = account.PL()
+	if steps > 0 {
+		r.MeanAbsPos = absPos / float64(steps)
+		r.Flat = float64(flat) / float64(steps)
+	}
+	if len(samples) > 1 {
+		var mean float64
+		for _, s := range samples {
+			mean += s
+		}
+		if sd := stat.Sd(samples); sd > 0 {
+			r.Sharpe = mean / float64(len(samples)) / sd
+		}
+	}
+
+	return r
+}
+
+// Count fills waiting on the account
+func drainFills(account *paper.Account, r *backtestResult) {
+	for {
+		select {
+		case fill := <-account.Fills:
+			quoter.Fill(fill)
+			r.Fills++
+		default:
+			return
+		}
+	}
+}
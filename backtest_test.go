@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bitmm/bitfinex"
+	"code.google.com/p/gcfg"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReadTrades(t *testing.T) {
+	trades, err := readTrades(strings.NewReader(`{"timestamp":2,"tid":11,"price":"250.5","amount":"1.5","exchange":"bitfinex"}
+
+{"timestamp":1,"tid":10,"price":"250","amount":"2","exchange":"bitfinex"}
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 2 || trades[0].TID != 10 || trades[1].Price != 250.5 || trades[1].Amount != 1.5 {
+		t.Fatalf("Unexpected trades %+v", trades)
+	}
+
+	// Recorded trades are added, repeated trades and other records are skipped
+	trades, err = readTrades(strings.NewReader(`{"type":"trade","symbol":"btcusd","exchange_time":3.5,"received_time":3.6,"trade":{"timestamp":3,"tid":12,"price":"251","amount":"1","exchange":"bitfinex","type":"buy"}}
+{"type":"trade","symbol":"btcusd","exchange_time":3.5,"received_time":3.6,"snapshot":true,"trade":{"timestamp":2,"tid":11,"price":"250.5","amount":"1.5","exchange":"bitfinex","type":"sell"}}
+{"type":"ticker","symbol":"btcusd","exchange_time":3.5,"received_time":3.6,"ticker":{"symbol":"btcusd","bid":250}}
+`), trades)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 3 || trades[2].TID != 12 || trades[2].Price != 251 {
+		t.Fatalf("Unexpected trades %+v", trades)
+	}
+	if _, err := readTrades(strings.NewReader("{\n{}\n"), nil); err == nil {
+		t.Fatal("Expected error for bad line")
+	}
+
+	// A recording whose last line was cut off is read up to it
+	trades, err = readTrades(strings.NewReader(`{"type":"trade","symbol":"btcusd","exchange_time":4.5,"received_time":4.6,"trade":{"timestamp":4,"tid":13,"price":"252","amount":"1","exchange":"bitfinex","type":"buy"}}
+{"type":"trade","symbol":"btcusd","exchange_time":5.5,"rec`), nil)
+	if err != nil || len(trades) != 1 || trades[0].TID != 13 {
+		t.Fatalf("Unexpected truncated trades %+v %v", trades, err)
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	err := gcfg.ReadFileInto(&cfg, "bitmm.gcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A market oscillating around 250, one trade a minute
+	var trades bitfinex.Trades
+	for i := 0; i < 1000; i++ {
+		trades = append(trades, bitfinex.Trade{
+			Timestamp: 60 * i,
+			TID:       i + 1,
+			Price:     250 + 5*math.Sin(float64(i)/10),
+			Amount:    1,
+		})
+	}
+
+	r := backtest(trades)
+	if r.Trades != 1000 || r.Fills == 0 {
+		t.Fatalf("Expected fills, got %+v", r)
+	}
+	if r.MaxLong > cfg.Sec.MaxPos || r.MaxShort < -cfg.Sec.MaxPos || r.MaxLong == 0 && r.MaxShort == 0 {
+		t.Fatalf("Unexpected positions %+v", r)
+	}
+	if r.MaxDrawdown < 0 || r.Flat < 0 || r.Flat > 1 || math.IsNaN(r.Sharpe) {
+		t.Fatalf("Unexpected statistics %+v", r)
+	}
+	if quoter.Live() {
+		t.Fatal("Orders left live")
+	}
+}
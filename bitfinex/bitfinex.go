@@ -3,17 +3,15 @@
 package bitfinex
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
-	"time"
 )
 
 // Bitfinex API URL
@@ -21,10 +19,41 @@ const (
 	APIURL = "https://api.bitfinex.com"
 )
 
-// Client stores Bitfinex credentials
+// Client stores Bitfinex credentials and connection settings
 type Client struct {
-	APIKey    string
-	APISecret string
+	APIKey      string
+	APISecret   string
+	baseURL     string       // API URL, APIURL if empty
+	httpClient  *http.Client // HTTP client, http.DefaultClient if nil
+	userAgent   string       // User-Agent header, Go default if empty
+	publicLimit *Limiter     // Limiter for unauthenticated requests, if any
+	authLimit   *Limiter     // Limiter for authenticated requests, if any
+	retryPolicy RetryPolicy  // Retries for idempotent requests, none by default
+	nonce       *Nonce       // Nonce source for authenticated requests
+}
+
+// Option configures a Client in New
+type Option func(*Client)
+
+// BaseURL sets the URL the client sends requests to
+func BaseURL(url string) Option {
+	return func(client *Client) {
+		client.baseURL = url
+	}
+}
+
+// HTTPClient sets the http.Client used for requests, e.g. to set timeouts
+func HTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// UserAgent sets the User-Agent header sent with requests
+func UserAgent(userAgent string) Option {
+	return func(client *Client) {
+		client.userAgent = userAgent
+	}
 }
 
 // ErrorMessage contains an error message from exchange
@@ -137,22 +166,82 @@ type Position struct {
 // Positions is a slice of Position
 type Positions []Position
 
+// Balance contains a wallet balance from the exchange
+type Balance struct {
+	Type      string  `json:"type"`             // Wallet, "trading", "deposit" or "exchange"
+	Currency  string  `json:"currency"`         // Currency, e.g. "usd"
+	Amount    float64 `json:"amount,string"`    // Total balance
+	Available float64 `json:"available,string"` // Balance not tied up in orders or positions
+}
+
+// Balances is a slice of Balance
+type Balances []Balance
+
+// PublicLimit limits unauthenticated requests such as Trades and Orderbook
+func PublicLimit(limiter *Limiter) Option {
+	return func(client *Client) {
+		client.publicLimit = limiter
+	}
+}
+
+// AuthLimit limits authenticated requests such as orders and positions
+func AuthLimit(limiter *Limiter) Option {
+	return func(client *Client) {
+		client.authLimit = limiter
+	}
+}
+
+// Retry sets the retry policy for idempotent requests
+func Retry(policy RetryPolicy) Option {
+	return func(client *Client) {
+		client.retryPolicy = policy
+	}
+}
+
 // New returns a new Client instance
-func New(key, secret string) Client {
-	return Client{key, secret}
+func New(key, secret string, options ...Option) Client {
+	client := Client{APIKey: key, APISecret: secret, nonce: NewNonce()}
+	for _, option := range options {
+		option(&client)
+	}
+
+	return client
+}
+
+// Budget returns the requests currently available to the public and authenticated
+// limiters, +Inf if unlimited
+func (client Client) Budget() (public, authenticated float64) {
+	return client.publicLimit.Budget(), client.authLimit.Budget()
 }
 
 // Trades gets trade data from the exchange
 func (client Client) Trades(symbol string, limitTrades int) (Trades, error) {
+	return client.TradesContext(context.Background(), symbol, limitTrades)
+}
+
+// TradesContext is like Trades but uses ctx for the request, retrying per the retry policy
+func (client Client) TradesContext(ctx context.Context, symbol string, limitTrades int) (Trades, error) {
+	var trades Trades
+	err := client.retry(ctx, func() error {
+		var err error
+		trades, err = client.trades(ctx, symbol, limitTrades)
+		return err
+	})
+
+	return trades, err
+}
+
+// trades makes a single Trades request
+func (client Client) trades(ctx context.Context, symbol string, limitTrades int) (Trades, error) {
 	var trades Trades
 
 	url := fmt.Sprintf("/v1/trades/%s?limit_trades=%d", symbol, limitTrades)
-	data, err := client.get(url)
+	data, err := client.get(ctx, url)
 	if err != nil {
 		return trades, err
 	}
 
-	err = json.Unmarshal(data, &trades)
+	err = decode(url, data, &trades)
 	if err != nil {
 		return trades, err
 	}
@@ -162,15 +251,32 @@ func (client Client) Trades(symbol string, limitTrades int) (Trades, error) {
 
 // Orderbook gets orderbook data from the exchange
 func (client Client) Orderbook(symbol string, limitBids, limitAsks int) (Book, error) {
+	return client.OrderbookContext(context.Background(), symbol, limitBids, limitAsks)
+}
+
+// OrderbookContext is like Orderbook but uses ctx for the request, retrying per the retry policy
+func (client Client) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (Book, error) {
+	var book Book
+	err := client.retry(ctx, func() error {
+		var err error
+		book, err = client.orderbook(ctx, symbol, limitBids, limitAsks)
+		return err
+	})
+
+	return book, err
+}
+
+// orderbook makes a single Orderbook request
+func (client Client) orderbook(ctx context.Context, symbol string, limitBids, limitAsks int) (Book, error) {
 	var book Book
 
 	url := fmt.Sprintf("/v1/book/%s?limit_bids=%d&limit_asks=%d", symbol, limitBids, limitAsks)
-	data, err := client.get(url)
+	data, err := client.get(ctx, url)
 	if err != nil {
 		return book, err
 	}
 
-	err = json.Unmarshal(data, &book)
+	err = decode(url, data, &book)
 	if err != nil {
 		return book, err
 	}
@@ -180,6 +286,16 @@ func (client Client) Orderbook(symbol string, limitBids, limitAsks int) (Book, e
 
 // NewOrder posts new order to the exchange
 func (client Client) NewOrder(symbol string, amount, price float64, exchange, side, otype string) (Order, error) {
+	return client.NewOrderContext(context.Background(), symbol, amount, price, exchange, side, otype)
+}
+
+// NewOrderContext is like NewOrder but uses ctx for the request
+func (client Client) NewOrderContext(ctx context.Context, symbol string, amount, price float64, exchange, side, otype string) (Order, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return Order{}, err
+	}
+
 	request := struct {
 		URL      string  `json:"request"`
 		Nonce    string  `json:"nonce"`
@@ -191,7 +307,7 @@ func (client Client) NewOrder(symbol string, amount, price float64, exchange, si
 		Type     string  `json:"type"`
 	}{
 		"/v1/order/new",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 		symbol,
 		amount,
 		price,
@@ -200,61 +316,107 @@ func (client Client) NewOrder(symbol string, amount, price float64, exchange, si
 		otype,
 	}
 
-	return client.postOrder(request.URL, request)
+	return client.postOrder(ctx, request.URL, request)
 }
 
 // MultipleNewOrders posts multiple new orders to the exchange
 func (client Client) MultipleNewOrders(params []OrderParams) (Orders, error) {
+	return client.MultipleNewOrdersContext(context.Background(), params)
+}
+
+// MultipleNewOrdersContext is like MultipleNewOrders but uses ctx for the request
+func (client Client) MultipleNewOrdersContext(ctx context.Context, params []OrderParams) (Orders, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return Orders{}, err
+	}
+
 	request := struct {
 		URL    string        `json:"request"`
 		Nonce  string        `json:"nonce"`
 		Params []OrderParams `json:"orders"`
 	}{
 		"/v1/order/new/multi",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 		params,
 	}
 
-	return client.postMultiOrder(request.URL, request)
+	return client.postMultiOrder(ctx, request.URL, request)
 }
 
 // CancelOrder cancels existing orders on the exchange
 func (client Client) CancelOrder(id int) (Order, error) {
+	return client.CancelOrderContext(context.Background(), id)
+}
+
+// CancelOrderContext is like CancelOrder but uses ctx for the request
+func (client Client) CancelOrderContext(ctx context.Context, id int) (Order, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return Order{}, err
+	}
+
 	request := struct {
 		URL     string `json:"request"`
 		Nonce   string `json:"nonce"`
 		OrderID int    `json:"order_id"`
 	}{
 		"/v1/order/cancel",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 		id,
 	}
 
-	return client.postOrder(request.URL, request)
+	return client.postOrder(ctx, request.URL, request)
 }
 
 // CancelAll cancels all active orders
 func (client Client) CancelAll() (bool, error) {
+	return client.CancelAllContext(context.Background())
+}
+
+// CancelAllContext is like CancelAll but uses ctx for the request, retrying per the retry policy
+func (client Client) CancelAllContext(ctx context.Context) (bool, error) {
+	var cancelled bool
+	err := client.retry(ctx, func() error {
+		var err error
+		cancelled, err = client.cancelAll(ctx)
+		if err == nil && !cancelled {
+			return errNotCancelled
+		}
+		return err
+	})
+	if err == errNotCancelled {
+		err = nil
+	}
+
+	return cancelled, err
+}
+
+// cancelAll makes a single CancelAll request
+func (client Client) cancelAll(ctx context.Context) (bool, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return false, err
+	}
+
 	request := struct {
 		URL   string `json:"request"`
 		Nonce string `json:"nonce"`
 	}{
 		"/v1/order/cancel/all",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 	}
 
-	data, err := client.post(request.URL, request)
+	data, err := client.post(ctx, request.URL, request)
+	if err != nil {
+		return false, err
+	}
 
 	var cancel Cancellation
 
-	err = json.Unmarshal(data, &cancel)
+	err = decode(request.URL, data, &cancel)
 	if err != nil {
-		var errorMessage ErrorMessage
-		err = json.Unmarshal(data, &errorMessage)
-		if err != nil {
-			return false, err
-		}
-		return false, errors.New(errorMessage.Message)
+		return false, err
 	}
 
 	success := cancel.Result == "All orders cancelled"
@@ -263,6 +425,16 @@ func (client Client) CancelAll() (bool, error) {
 
 // ReplaceOrder replaces existing orders on the exchange
 func (client Client) ReplaceOrder(id int, symbol string, amount, price float64, exchange, side, otype string) (Order, error) {
+	return client.ReplaceOrderContext(context.Background(), id, symbol, amount, price, exchange, side, otype)
+}
+
+// ReplaceOrderContext is like ReplaceOrder but uses ctx for the request
+func (client Client) ReplaceOrderContext(ctx context.Context, id int, symbol string, amount, price float64, exchange, side, otype string) (Order, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return Order{}, err
+	}
+
 	request := struct {
 		URL      string  `json:"request"`
 		Nonce    string  `json:"nonce"`
@@ -275,7 +447,7 @@ func (client Client) ReplaceOrder(id int, symbol string, amount, price float64,
 		Type     string  `json:"type"`
 	}{
 		"/v1/order/cancel/replace",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 		id,
 		symbol,
 		amount,
@@ -285,115 +457,245 @@ func (client Client) ReplaceOrder(id int, symbol string, amount, price float64,
 		otype,
 	}
 
-	return client.postOrder(request.URL, request)
+	return client.postOrder(ctx, request.URL, request)
 }
 
 // OrderStatus gets order status
 func (client Client) OrderStatus(id int) (Order, error) {
+	return client.OrderStatusContext(context.Background(), id)
+}
+
+// OrderStatusContext is like OrderStatus but uses ctx for the request, retrying per the retry policy
+func (client Client) OrderStatusContext(ctx context.Context, id int) (Order, error) {
+	var order Order
+	err := client.retry(ctx, func() error {
+		var err error
+		order, err = client.orderStatus(ctx, id)
+		return err
+	})
+
+	return order, err
+}
+
+// orderStatus makes a single OrderStatus request
+func (client Client) orderStatus(ctx context.Context, id int) (Order, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return Order{}, err
+	}
+
 	request := struct {
 		URL     string `json:"request"`
 		Nonce   string `json:"nonce"`
 		OrderID int    `json:"order_id"`
 	}{
 		"/v1/order/status",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 		id,
 	}
 
-	return client.postOrder(request.URL, request)
+	return client.postOrder(ctx, request.URL, request)
 }
 
 // ActivePositions returns active positions from the exchange
 func (client Client) ActivePositions() (Positions, error) {
+	return client.ActivePositionsContext(context.Background())
+}
+
+// ActivePositionsContext is like ActivePositions but uses ctx for the request, retrying per the retry policy
+func (client Client) ActivePositionsContext(ctx context.Context) (Positions, error) {
+	var positions Positions
+	err := client.retry(ctx, func() error {
+		var err error
+		positions, err = client.activePositions(ctx)
+		return err
+	})
+
+	return positions, err
+}
+
+// activePositions makes a single ActivePositions request
+func (client Client) activePositions(ctx context.Context) (Positions, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	request := struct {
 		URL   string `json:"request"`
 		Nonce string `json:"nonce"`
 	}{
 		"/v1/positions",
-		strconv.FormatInt(time.Now().UnixNano(), 10),
+		nonce,
 	}
 
 	var positions Positions
-	data, err := client.post(request.URL, request)
+	data, err := client.post(ctx, request.URL, request)
 	if err != nil {
 		return positions, err
 	}
 
-	err = json.Unmarshal(data, &positions)
+	err = decode(request.URL, data, &positions)
 	if err != nil {
-		var errorMessage ErrorMessage
-		err = json.Unmarshal(data, &errorMessage)
-		if err != nil {
-			return positions, err
-		}
-
-		return positions, errors.New(errorMessage.Message)
+		return positions, err
 	}
 
 	return positions, nil
 }
 
-// TODO: ActiveOrders
+// ActiveOrders returns active orders from the exchange
+func (client Client) ActiveOrders() ([]Order, error) {
+	return client.ActiveOrdersContext(context.Background())
+}
+
+// ActiveOrdersContext is like ActiveOrders but uses ctx for the request, retrying per the retry policy
+func (client Client) ActiveOrdersContext(ctx context.Context) ([]Order, error) {
+	var orders []Order
+	err := client.retry(ctx, func() error {
+		var err error
+		orders, err = client.activeOrders(ctx)
+		return err
+	})
+
+	return orders, err
+}
+
+// activeOrders makes a single ActiveOrders request
+func (client Client) activeOrders(ctx context.Context) ([]Order, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	request := struct {
+		URL   string `json:"request"`
+		Nonce string `json:"nonce"`
+	}{
+		"/v1/orders",
+		nonce,
+	}
+
+	var orders []Order
+	data, err := client.post(ctx, request.URL, request)
+	if err != nil {
+		return orders, err
+	}
+
+	err = decode(request.URL, data, &orders)
+	if err != nil {
+		return orders, err
+	}
+
+	return orders, nil
+}
+
+// Balances returns wallet balances from the exchange
+func (client Client) Balances() (Balances, error) {
+	return client.BalancesContext(context.Background())
+}
+
+// BalancesContext is like Balances but uses ctx for the request, retrying per the retry policy
+func (client Client) BalancesContext(ctx context.Context) (Balances, error) {
+	var balances Balances
+	err := client.retry(ctx, func() error {
+		var err error
+		balances, err = client.balances(ctx)
+		return err
+	})
+
+	return balances, err
+}
+
+// balances makes a single Balances request
+func (client Client) balances(ctx context.Context) (Balances, error) {
+	nonce, err := client.nextNonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	request := struct {
+		URL   string `json:"request"`
+		Nonce string `json:"nonce"`
+	}{
+		"/v1/balances",
+		nonce,
+	}
+
+	var balances Balances
+	data, err := client.post(ctx, request.URL, request)
+	if err != nil {
+		return balances, err
+	}
+
+	err = decode(request.URL, data, &balances)
+	if err != nil {
+		return balances, err
+	}
+
+	return balances, nil
+}
 
 // postOrder is used in order-related API methods
-func (client Client) postOrder(url string, request interface{}) (Order, error) {
+func (client Client) postOrder(ctx context.Context, url string, request interface{}) (Order, error) {
 	var order Order
 
-	data, err := client.post(url, request)
+	data, err := client.post(ctx, url, request)
 	if err != nil {
 		return order, err
 	}
 
-	err = json.Unmarshal(data, &order)
+	err = decode(url, data, &order)
 	if err != nil {
-		var errorMessage ErrorMessage
-		err = json.Unmarshal(data, &errorMessage)
-		if err != nil {
-			return order, err
-		}
-
-		return order, errors.New(errorMessage.Message)
+		return order, err
 	}
 
 	return order, nil
 }
 
 // postMultiOrder is used in multi order-related API methods
-func (client Client) postMultiOrder(url string, request interface{}) (Orders, error) {
+func (client Client) postMultiOrder(ctx context.Context, url string, request interface{}) (Orders, error) {
 	var orders Orders
 
-	data, err := client.post(url, request)
+	data, err := client.post(ctx, url, request)
 	if err != nil {
 		return orders, err
 	}
 
-	err = json.Unmarshal(data, &orders)
+	err = decode(url, data, &orders)
 	if err != nil {
-		var errorMessage ErrorMessage
-		err = json.Unmarshal(data, &errorMessage)
-		if err != nil {
-			return orders, err
-		}
-
-		return orders, errors.New(errorMessage.Message)
+		return orders, err
 	}
 
 	return orders, nil
 }
 
+// decode unmarshals a successful response, falling back to the exchange error message
+func decode(url string, data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return newAPIError(http.StatusOK, url, data, err)
+	}
+
+	return nil
+}
+
 // get executes an unauthenticated GET
-func (client Client) get(url string) ([]byte, error) {
-	resp, err := http.Get(APIURL + url)
+func (client Client) get(ctx context.Context, url string) ([]byte, error) {
+	err := client.publicLimit.take(ctx, "public")
+	if err != nil {
+		return []byte{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", client.url(url), nil)
 	if err != nil {
 		return []byte{}, err
 	}
-	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	return client.do(req)
 }
 
 // post executes an authenticated POST
-func (client Client) post(url string, payload interface{}) ([]byte, error) {
+func (client Client) post(ctx context.Context, url string, payload interface{}) ([]byte, error) {
 	// Payload = parameters-dictionary -> JSON encode -> base64
 	payloadJSON, err := json.Marshal(payload)
 	if err != nil {
@@ -406,9 +708,7 @@ func (client Client) post(url string, payload interface{}) ([]byte, error) {
 	h.Write([]byte(payloadBase64))
 	signature := hex.EncodeToString(h.Sum(nil))
 
-	httpClient := &http.Client{}
-	req, err := http.NewRequest("POST", APIURL+url, nil)
-	// req.Close = true
+	req, err := http.NewRequestWithContext(ctx, "POST", client.url(url), nil)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -421,11 +721,43 @@ func (client Client) post(url string, payload interface{}) ([]byte, error) {
 	req.Header.Add("X-BFX-PAYLOAD", payloadBase64)
 	req.Header.Add("X-BFX-SIGNATURE", signature)
 
+	return client.do(req)
+}
+
+// do sends a request with the configured http.Client and reads the response
+func (client Client) do(req *http.Request) ([]byte, error) {
+	if client.userAgent != "" {
+		req.Header.Set("User-Agent", client.userAgent)
+	}
+
+	httpClient := client.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return []byte{}, err
 	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return data, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return data, newAPIError(resp.StatusCode, req.URL.Path, data, nil)
+	}
+
+	return data, nil
+}
+
+// url returns the full URL for an API path
+func (client Client) url(path string) string {
+	if client.baseURL == "" {
+		return APIURL + path
+	}
+
+	return client.baseURL + path
 }
@@ -1,15 +1,46 @@
-// This contains live order tests and requires environment variables BITFINEX_KEY and BITFINEX_SECRET
+// Tests run against an in-memory fake exchange by default. Run with -live to
+// place real orders using environment variables BITFINEX_KEY and BITFINEX_SECRET
 
 package bitfinex
 
 import (
 	// "github.com/davecgh/go-spew/spew"
+	"bitmm/bitfinex/fakeexchange"
+	"context"
+	"errors"
+	"flag"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
-var client = New(os.Getenv("BITFINEX_KEY"), os.Getenv("BITFINEX_SECRET"))
+var (
+	live     = flag.Bool("live", false, "Run tests against the live exchange")
+	client   Client
+	exchange *fakeexchange.Server // nil when running live
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	if *live {
+		client = New(os.Getenv("BITFINEX_KEY"), os.Getenv("BITFINEX_SECRET"))
+		os.Exit(m.Run())
+	}
+
+	exchange = fakeexchange.New("key", "secret")
+	for i := 0; i < 20; i++ {
+		exchange.AddTrade("ltcusd", 3.80+float64(i%5)*0.01, 1)
+	}
+	client = New(exchange.Key, exchange.Secret, BaseURL(exchange.URL))
+
+	code := m.Run()
+	exchange.Close()
+	os.Exit(code)
+}
 
 func TestTrades(t *testing.T) {
 	// Test good request
@@ -173,4 +204,148 @@ func TestActivePositions(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	if exchange == nil {
+		return
+	}
+
+	// Test position after a scripted fill
+	order, err := client.NewOrder("ltcusd", 0.5, 3.70, "bitfinex", "buy", "limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = exchange.Fill(order.ID, 0.2); err != nil {
+		t.Fatal(err)
+	}
+	defer exchange.SetPosition("ltcusd", 0)
+	defer client.CancelOrder(order.ID)
+
+	positions, err := client.ActivePositions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 1 || positions[0].Symbol != "ltcusd" || math.Abs(positions[0].Amount-0.2) > 0.000001 {
+		t.Fatal("Expected position of 0.2 ltcusd")
+	}
+
+	order, err = client.OrderStatus(order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !order.IsLive || math.Abs(order.ExecutedAmount-0.2) > 0.000001 || math.Abs(order.RemainingAmount-0.3) > 0.000001 {
+		t.Fatal("Expected partially filled order")
+	}
+}
+
+func TestActiveOrders(t *testing.T) {
+	// Get a current price to use for trade
+	trades, err := client.Trades("ltcusd", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	price := trades[0].Price + 0.20
+
+	order, err := client.NewOrder("ltcusd", 0.1, price, "bitfinex", "sell", "limit")
+	if err != nil || order.ID == 0 {
+		t.Fatal(err)
+	}
+	defer client.CancelOrder(order.ID)
+
+	// Test the new order is listed
+	orders, err := client.ActiveOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, o := range orders {
+		if o.ID == order.ID {
+			found = true
+			if o.Symbol != "ltcusd" || !o.IsLive || math.Abs(o.Price-price) > 0.000001 {
+				t.Fatal("Active order does not match")
+			}
+			if math.Abs(o.RemainingAmount-0.1) > 0.000001 {
+				t.Fatal("Remaining amount does not match")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Expected new order in active orders")
+	}
+
+	// Test error message from the exchange
+	if exchange != nil {
+		exchange.Fail("/v1/orders", http.StatusBadRequest, "Could not find a key matching the given X-BFX-APIKEY.")
+		_, err = client.ActiveOrders()
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Message != "Could not find a key matching the given X-BFX-APIKEY." {
+			t.Fatal("Expected exchange error message")
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(`[{"timestamp":1444266681,"tid":11988919,"price":"244.8","amount":"0.03297384","exchange":"bitfinex","type":"sell"}]`))
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	client := New("key", "secret", BaseURL(server.URL), HTTPClient(httpClient), UserAgent("bitmm"))
+	if client.httpClient != httpClient {
+		t.Fatal("HTTP client not set")
+	}
+
+	trades, err := client.Trades("btcusd", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) != 1 || trades[0].TID != 11988919 {
+		t.Fatal("Trade does not match")
+	}
+	if userAgent != "bitmm" {
+		t.Fatalf("Expected User-Agent bitmm, got %s", userAgent)
+	}
+}
+
+func TestContext(t *testing.T) {
+	// Server that never responds before the client gives up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client := New("key", "secret", BaseURL(server.URL))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.TradesContext(ctx, "btcusd", 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = client.CancelAllContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancelled, got %v", err)
+	}
+}
+
+func TestBalances(t *testing.T) {
+	if exchange != nil {
+		exchange.SetBalance("trading", "usd", 1000, 750)
+	}
+
+	balances, err := client.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exchange != nil {
+		if len(balances) != 1 || balances[0].Type != "trading" || balances[0].Currency != "usd" ||
+			balances[0].Amount != 1000 || balances[0].Available != 750 {
+			t.Fatalf("Unexpected balances %+v", balances)
+		}
+	}
 }
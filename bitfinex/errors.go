@@ -0,0 +1,101 @@
+// Bitfinex API errors
+
+package bitfinex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error classes for use with errors.Is on an APIError
+var (
+	ErrRateLimited        = errors.New("bitfinex: rate limited")
+	ErrInvalidNonce       = errors.New("bitfinex: invalid nonce")
+	ErrInsufficientMargin = errors.New("bitfinex: insufficient margin")
+	ErrUnknownOrder       = errors.New("bitfinex: unknown order")
+	ErrAuth               = errors.New("bitfinex: authentication failed")
+
+	// ErrRejected is matched, as well as any class, by the errors of requests
+	// the exchange or the client's rate limit definitely refused, unlike a
+	// timeout or server error after which the request may have taken effect.
+	// Nonce and authentication failures are not, as no request will succeed.
+	ErrRejected = errors.New("bitfinex: request rejected")
+)
+
+// APIError is an error response, or an unreadable response, from the exchange
+type APIError struct {
+	StatusCode int    // HTTP status code
+	Endpoint   string // API path, e.g. "/v1/order/new"
+	Message    string // Message returned by the exchange, if any
+	Body       []byte // Raw response body
+	Err        error  // Decoding error if the body was not understood
+}
+
+// newAPIError builds an APIError, extracting the exchange message from body
+func newAPIError(statusCode int, url string, body []byte, err error) *APIError {
+	var errorMessage ErrorMessage
+	json.Unmarshal(body, &errorMessage)
+	if errorMessage.Message != "" {
+		err = nil
+	}
+
+	return &APIError{
+		StatusCode: statusCode,
+		Endpoint:   strings.SplitN(url, "?", 2)[0],
+		Message:    errorMessage.Message,
+		Body:       body,
+		Err:        err,
+	}
+}
+
+// Error returns the exchange message, or a description of the bad response
+func (err *APIError) Error() string {
+	switch {
+	case err.Message != "":
+		return fmt.Sprintf("bitfinex %s (%d): %s", err.Endpoint, err.StatusCode, err.Message)
+	case err.Err != nil:
+		return fmt.Sprintf("bitfinex %s (%d): bad response: %s", err.Endpoint, err.StatusCode, err.Err)
+	default:
+		return fmt.Sprintf("bitfinex %s (%d): %s", err.Endpoint, err.StatusCode, http.StatusText(err.StatusCode))
+	}
+}
+
+// Unwrap returns the decoding error, if any
+func (err *APIError) Unwrap() error {
+	return err.Err
+}
+
+// Is reports whether the error belongs to one of the error classes, or is a
+// client error response refusing the request itself
+func (err *APIError) Is(target error) bool {
+	if target == ErrRejected {
+		class := err.class()
+		return err.StatusCode >= 400 && err.StatusCode < 500 && class != ErrInvalidNonce && class != ErrAuth
+	}
+
+	return target != nil && target == err.class()
+}
+
+// class returns the error class for the status code and exchange message
+func (err *APIError) class() error {
+	message := strings.ToLower(err.Message)
+	switch {
+	case err.StatusCode == http.StatusTooManyRequests || strings.Contains(message, "ratelimit") ||
+		strings.Contains(message, "rate_limit") || strings.Contains(message, "rate limit"):
+		return ErrRateLimited
+	case strings.Contains(message, "nonce"):
+		return ErrInvalidNonce
+	case strings.Contains(message, "not enough") || strings.Contains(message, "insufficient"):
+		return ErrInsufficientMargin
+	case strings.Contains(message, "no such order") || strings.Contains(message, "order could not be cancelled"):
+		return ErrUnknownOrder
+	case err.StatusCode == http.StatusUnauthorized || strings.Contains(message, "x-bfx-apikey") ||
+		strings.Contains(message, "x-bfx-signature"):
+		return ErrAuth
+	}
+
+	return nil
+}
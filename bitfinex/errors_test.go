@@ -0,0 +1,80 @@
+package bitfinex
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAPIErrorClass(t *testing.T) {
+	tests := []struct {
+		status  int
+		message string
+		class   error
+	}{
+		{http.StatusTooManyRequests, "", ErrRateLimited},
+		{http.StatusBadRequest, "ERR_RATE_LIMIT", ErrRateLimited},
+		{http.StatusBadRequest, "Nonce is too small.", ErrInvalidNonce},
+		{http.StatusBadRequest, "Invalid order: not enough tradable balance for 10.0 BTCUSD at 250.0", ErrInsufficientMargin},
+		{http.StatusBadRequest, "No such order found.", ErrUnknownOrder},
+		{http.StatusBadRequest, "Order could not be cancelled.", ErrUnknownOrder},
+		{http.StatusBadRequest, "Could not find a key matching the given X-BFX-APIKEY.", ErrAuth},
+		{http.StatusBadRequest, "Invalid X-BFX-SIGNATURE.", ErrAuth},
+		{http.StatusUnauthorized, "", ErrAuth},
+		{http.StatusBadRequest, "Unknown symbol", nil},
+	}
+
+	classes := []error{ErrRateLimited, ErrInvalidNonce, ErrInsufficientMargin, ErrUnknownOrder, ErrAuth}
+	for _, test := range tests {
+		err := error(&APIError{StatusCode: test.status, Message: test.message})
+		for _, class := range classes {
+			if errors.Is(err, class) != (class == test.class) {
+				t.Fatalf("%d %q: errors.Is(%v) should be %v", test.status, test.message, class, class == test.class)
+			}
+		}
+		if rejected := test.class != ErrInvalidNonce && test.class != ErrAuth; errors.Is(err, ErrRejected) != rejected {
+			t.Fatalf("%d %q: errors.Is(ErrRejected) should be %v", test.status, test.message, rejected)
+		}
+	}
+
+	// The request may have taken effect after a server error
+	if err := error(&APIError{StatusCode: http.StatusBadGateway}); errors.Is(err, ErrRejected) {
+		t.Fatal("Server error should not be rejected")
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	if exchange == nil {
+		t.Skip("Requires the fake exchange")
+	}
+
+	// Test HTTP status and message on a bad symbol
+	_, err := client.Trades("badsymbol", 10)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Endpoint != "/v1/trades/badsymbol" || apiErr.Message != "Unknown symbol" {
+		t.Fatalf("Unexpected APIError %+v", apiErr)
+	}
+
+	// Test unknown order classification
+	_, err = client.OrderStatus(999999)
+	if !errors.Is(err, ErrUnknownOrder) {
+		t.Fatalf("Expected unknown order, got %v", err)
+	}
+
+	// Test rate limiting without a message
+	exchange.Fail("/v1/positions", http.StatusTooManyRequests, "")
+	_, err = client.ActivePositions()
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected rate limited, got %v", err)
+	}
+
+	// Test non-JSON response
+	exchange.Fail("/v1/positions", http.StatusOK, "")
+	_, err = client.ActivePositions()
+	if !errors.As(err, &apiErr) || apiErr.Err == nil || len(apiErr.Body) == 0 {
+		t.Fatalf("Expected APIError with decoding error, got %v", err)
+	}
+}
@@ -0,0 +1,728 @@
+// In-memory Bitfinex exchange for offline tests
+
+package fakeexchange
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves the Bitfinex v1 REST endpoints from memory
+type Server struct {
+	*httptest.Server
+	Key    string // API key accepted by the server
+	Secret string // API secret used to verify signatures
+
+	mu        sync.Mutex
+	trades    map[string][]Trade // Public trades per symbol, newest first
+	orders    map[int]*Order     // All orders ever placed, by ID
+	positions map[string]float64 // Position amount per symbol
+	balances  []balance
+	failures  map[string][]failure
+	requests  map[string]int
+	nextID    int
+	nextTID   int
+	lastNonce int64
+}
+
+// Trade is a public trade on the fake exchange
+type Trade struct {
+	Timestamp int     `json:"timestamp"`
+	TID       int     `json:"tid"`
+	Price     float64 `json:"price,string"`
+	Amount    float64 `json:"amount,string"`
+	Exchange  string  `json:"exchange"`
+	Type      string  `json:"type"`
+}
+
+// Order is an order resting on or removed from the fake exchange
+type Order struct {
+	ID             int
+	Symbol         string
+	Exchange       string
+	Side           string
+	Type           string
+	Price          float64
+	OriginalAmount float64
+	ExecutedAmount float64
+	AvgPrice       float64
+	IsLive         bool
+	IsCancelled    bool
+	Timestamp      time.Time
+}
+
+// failure is a scripted error response
+type failure struct {
+	status  int
+	message string
+}
+
+// orderRequest contains order fields sent by the client
+type orderRequest struct {
+	URL      string  `json:"request"`
+	Nonce    string  `json:"nonce"`
+	OrderID  int     `json:"order_id"`
+	Symbol   string  `json:"symbol"`
+	Amount   float64 `json:"amount,string"`
+	Price    float64 `json:"price,string"`
+	Exchange string  `json:"exchange"`
+	Side     string  `json:"side"`
+	Type     string  `json:"type"`
+	Orders   []struct {
+		Symbol   string  `json:"symbol"`
+		Amount   float64 `json:"amount,string"`
+		Price    float64 `json:"price,string"`
+		Exchange string  `json:"exchange"`
+		Side     string  `json:"side"`
+		Type     string  `json:"type"`
+	} `json:"orders"`
+}
+
+// orderStatus is the wire format of a single order response
+type orderStatus struct {
+	ID              int     `json:"id"`
+	Symbol          string  `json:"symbol"`
+	Exchange        string  `json:"exchange"`
+	Price           float64 `json:"price,string"`
+	ExecutionPrice  float64 `json:"avg_execution_price,string"`
+	Side            string  `json:"side"`
+	Type            string  `json:"type"`
+	Timestamp       string  `json:"timestamp"`
+	IsLive          bool    `json:"is_live"`
+	IsCancelled     bool    `json:"is_cancelled"`
+	WasForced       bool    `json:"was_forced"`
+	OriginalAmount  float64 `json:"original_amount,string"`
+	RemainingAmount float64 `json:"remaining_amount,string"`
+	ExecutedAmount  float64 `json:"executed_amount,string"`
+}
+
+// multiOrderStatus is the wire format of an order in a multi order response
+type multiOrderStatus struct {
+	ID             int     `json:"id"`
+	Pair           string  `json:"pair"`
+	Amount         float64 `json:"amount,string"`
+	OriginalAmount float64 `json:"originalamount,string"`
+	Price          float64 `json:"price,string"`
+	AvgPrice       float64 `json:"avg_price,string"`
+	Type           string  `json:"type"`
+	Status         string  `json:"status"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+}
+
+// bookItem is the wire format of an orderbook level
+type bookItem struct {
+	Price     float64 `json:"price,string"`
+	Amount    float64 `json:"amount,string"`
+	Timestamp string  `json:"timestamp"`
+}
+
+// balance is the wire format of a wallet balance
+type balance struct {
+	Type      string  `json:"type"`
+	Currency  string  `json:"currency"`
+	Amount    float64 `json:"amount,string"`
+	Available float64 `json:"available,string"`
+}
+
+// position is the wire format of a position
+type position struct {
+	ID        int     `json:"id"`
+	Symbol    string  `json:"symbol"`
+	Status    string  `json:"status"`
+	Base      float64 `json:"base,string"`
+	Amount    float64 `json:"amount,string"`
+	Timestamp string  `json:"timestamp"`
+	Swap      float64 `json:"swap,string"`
+	PL        float64 `json:"pl,string"`
+}
+
+// Error messages returned by the fake exchange
+const (
+	msgUnknownSymbol = "Unknown symbol"
+	msgBadKey        = "Could not find a key matching the given X-BFX-APIKEY."
+	msgBadSignature  = "Invalid X-BFX-SIGNATURE."
+	msgBadNonce      = "Nonce is too small."
+	msgNoOrder       = "No such order found."
+	msgNotCancelled  = "Order could not be cancelled."
+	msgBadAmount     = "Invalid order: minimum size for %s is 0.01"
+)
+
+// New starts a fake exchange accepting the given credentials
+func New(key, secret string) *Server {
+	server := &Server{
+		Key:       key,
+		Secret:    secret,
+		trades:    make(map[string][]Trade),
+		orders:    make(map[int]*Order),
+		positions: make(map[string]float64),
+		failures:  make(map[string][]failure),
+		requests:  make(map[string]int),
+		nextID:    1,
+		nextTID:   1,
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+
+	return server
+}
+
+// AddTrade records a public trade and makes the symbol known to the exchange
+func (server *Server) AddTrade(symbol string, price, amount float64) Trade {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.addTrade(symbol, price, amount, "")
+}
+
+// SetPosition sets the position returned for a symbol
+func (server *Server) SetPosition(symbol string, amount float64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.positions[symbol] = amount
+}
+
+// SetBalance sets a wallet balance returned by /v1/balances
+func (server *Server) SetBalance(wallet, currency string, amount, available float64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for i, b := range server.balances {
+		if b.Type == wallet && b.Currency == currency {
+			server.balances[i] = balance{wallet, currency, amount, available}
+			return
+		}
+	}
+	server.balances = append(server.balances, balance{wallet, currency, amount, available})
+}
+
+// Position returns the current position for a symbol
+func (server *Server) Position(symbol string) float64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.positions[symbol]
+}
+
+// Fail makes the next request to path fail with the given HTTP status and message
+func (server *Server) Fail(path string, status int, message string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.failures[path] = append(server.failures[path], failure{status, message})
+}
+
+// Fill executes amount of a live order at its limit price
+func (server *Server) Fill(id int, amount float64) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	order, ok := server.orders[id]
+	if !ok || !order.IsLive {
+		return errors.New(msgNoOrder)
+	}
+	server.fill(order, amount, order.Price)
+
+	return nil
+}
+
+// Orders returns all live orders sorted by ID
+func (server *Server) Orders() []Order {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.liveOrders()
+}
+
+// Order returns the order with the given ID
+func (server *Server) Order(id int) (Order, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	order, ok := server.orders[id]
+	if !ok {
+		return Order{}, false
+	}
+
+	return *order, true
+}
+
+// Requests returns the number of requests received for path
+func (server *Server) Requests(path string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.requests[path]
+}
+
+// handle routes a request to its endpoint
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	path := r.URL.Path
+	route := path
+	if strings.HasPrefix(path, "/v1/trades/") {
+		route = "/v1/trades"
+	} else if strings.HasPrefix(path, "/v1/book/") {
+		route = "/v1/book"
+	}
+	server.requests[route]++
+
+	if failures := server.failures[route]; len(failures) > 0 {
+		server.failures[route] = failures[1:]
+		writeError(w, failures[0].status, failures[0].message)
+		return
+	}
+
+	switch route {
+	case "/v1/trades":
+		server.handleTrades(w, r, strings.TrimPrefix(path, "/v1/trades/"))
+		return
+	case "/v1/book":
+		server.handleBook(w, r, strings.TrimPrefix(path, "/v1/book/"))
+		return
+	}
+
+	var request orderRequest
+	if status, message := server.authenticate(r, &request); status != http.StatusOK {
+		writeError(w, status, message)
+		return
+	}
+
+	switch route {
+	case "/v1/order/new":
+		server.handleNewOrder(w, request)
+	case "/v1/order/new/multi":
+		server.handleMultipleNewOrders(w, request)
+	case "/v1/order/cancel":
+		server.handleCancelOrder(w, request)
+	case "/v1/order/cancel/all":
+		server.handleCancelAll(w)
+	case "/v1/order/cancel/replace":
+		server.handleReplaceOrder(w, request)
+	case "/v1/order/status":
+		server.handleOrderStatus(w, request)
+	case "/v1/orders":
+		server.handleActiveOrders(w)
+	case "/v1/positions":
+		server.handleActivePositions(w)
+	case "/v1/balances":
+		writeJSON(w, append([]balance{}, server.balances...))
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// authenticate verifies the key, signature and nonce of a request and decodes its payload
+func (server *Server) authenticate(r *http.Request, request *orderRequest) (int, string) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, "Method not allowed"
+	}
+	if r.Header.Get("X-BFX-APIKEY") != server.Key {
+		return http.StatusBadRequest, msgBadKey
+	}
+
+	payload := r.Header.Get("X-BFX-PAYLOAD")
+	h := hmac.New(sha512.New384, []byte(server.Secret))
+	h.Write([]byte(payload))
+	signature, err := hex.DecodeString(r.Header.Get("X-BFX-SIGNATURE"))
+	if err != nil || !hmac.Equal(signature, h.Sum(nil)) {
+		return http.StatusBadRequest, msgBadSignature
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return http.StatusBadRequest, "Invalid X-BFX-PAYLOAD."
+	}
+	err = json.Unmarshal(data, request)
+	if err != nil || request.URL != r.URL.Path {
+		return http.StatusBadRequest, "Invalid X-BFX-PAYLOAD."
+	}
+
+	nonce, err := strconv.ParseInt(request.Nonce, 10, 64)
+	if err != nil || nonce <= server.lastNonce {
+		return http.StatusBadRequest, msgBadNonce
+	}
+	server.lastNonce = nonce
+
+	return http.StatusOK, ""
+}
+
+// handleTrades serves /v1/trades/:symbol
+func (server *Server) handleTrades(w http.ResponseWriter, r *http.Request, symbol string) {
+	trades, ok := server.trades[symbol]
+	if !ok {
+		writeError(w, http.StatusBadRequest, msgUnknownSymbol)
+		return
+	}
+
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit_trades")); err == nil {
+		limit = l
+	}
+	if limit < len(trades) {
+		trades = trades[:limit]
+	}
+
+	writeJSON(w, trades)
+}
+
+// handleBook serves /v1/book/:symbol, aggregating live orders by price
+func (server *Server) handleBook(w http.ResponseWriter, r *http.Request, symbol string) {
+	if _, ok := server.trades[symbol]; !ok {
+		writeError(w, http.StatusBadRequest, msgUnknownSymbol)
+		return
+	}
+
+	bids := make(map[float64]float64)
+	asks := make(map[float64]float64)
+	for _, order := range server.orders {
+		if order.IsLive && order.Symbol == symbol {
+			if order.Side == "buy" {
+				bids[order.Price] += order.OriginalAmount - order.ExecutedAmount
+			} else {
+				asks[order.Price] += order.OriginalAmount - order.ExecutedAmount
+			}
+		}
+	}
+
+	limitBids, limitAsks := 50, 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit_bids")); err == nil {
+		limitBids = l
+	}
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit_asks")); err == nil {
+		limitAsks = l
+	}
+
+	writeJSON(w, struct {
+		Bids []bookItem `json:"bids"`
+		Asks []bookItem `json:"asks"`
+	}{
+		bookSide(bids, limitBids, true),
+		bookSide(asks, limitAsks, false),
+	})
+}
+
+// handleNewOrder serves /v1/order/new
+func (server *Server) handleNewOrder(w http.ResponseWriter, request orderRequest) {
+	order, message := server.newOrder(request.Symbol, request.Amount, request.Price,
+		request.Exchange, request.Side, request.Type)
+	if message != "" {
+		writeError(w, http.StatusBadRequest, message)
+		return
+	}
+
+	writeJSON(w, statusOf(order))
+}
+
+// handleMultipleNewOrders serves /v1/order/new/multi, placing no orders if
+// any is invalid
+func (server *Server) handleMultipleNewOrders(w http.ResponseWriter, request orderRequest) {
+	for _, params := range request.Orders {
+		if message := server.validate(params.Symbol, params.Amount, params.Side); message != "" {
+			writeError(w, http.StatusBadRequest, message)
+			return
+		}
+	}
+	var orders []multiOrderStatus
+	for _, params := range request.Orders {
+		order := server.place(params.Symbol, params.Amount, params.Price, params.Exchange, params.Side, params.Type)
+		orders = append(orders, multiStatusOf(order))
+	}
+
+	writeJSON(w, struct {
+		Orders []multiOrderStatus `json:"order_ids"`
+		Status string             `json:"status"`
+	}{orders, "success"})
+}
+
+// handleCancelOrder serves /v1/order/cancel
+func (server *Server) handleCancelOrder(w http.ResponseWriter, request orderRequest) {
+	order, ok := server.orders[request.OrderID]
+	if !ok || !order.IsLive {
+		writeError(w, http.StatusBadRequest, msgNotCancelled)
+		return
+	}
+	order.IsLive = false
+	order.IsCancelled = true
+
+	writeJSON(w, statusOf(order))
+}
+
+// handleCancelAll serves /v1/order/cancel/all
+func (server *Server) handleCancelAll(w http.ResponseWriter) {
+	for _, order := range server.orders {
+		if order.IsLive {
+			order.IsLive = false
+			order.IsCancelled = true
+		}
+	}
+
+	writeJSON(w, struct {
+		Result string `json:"result"`
+	}{"All orders cancelled"})
+}
+
+// handleReplaceOrder serves /v1/order/cancel/replace, leaving the old order
+// live if the new one is invalid
+func (server *Server) handleReplaceOrder(w http.ResponseWriter, request orderRequest) {
+	old, ok := server.orders[request.OrderID]
+	if !ok || !old.IsLive {
+		writeError(w, http.StatusBadRequest, msgNotCancelled)
+		return
+	}
+	if message := server.validate(request.Symbol, request.Amount, request.Side); message != "" {
+		writeError(w, http.StatusBadRequest, message)
+		return
+	}
+	old.IsLive = false
+	old.IsCancelled = true
+
+	order := server.place(request.Symbol, request.Amount, request.Price, request.Exchange, request.Side, request.Type)
+	writeJSON(w, statusOf(order))
+}
+
+// handleOrderStatus serves /v1/order/status
+func (server *Server) handleOrderStatus(w http.ResponseWriter, request orderRequest) {
+	order, ok := server.orders[request.OrderID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, msgNoOrder)
+		return
+	}
+
+	writeJSON(w, statusOf(order))
+}
+
+// handleActiveOrders serves /v1/orders
+func (server *Server) handleActiveOrders(w http.ResponseWriter) {
+	orders := []orderStatus{}
+	for _, order := range server.liveOrders() {
+		orders = append(orders, statusOf(&order))
+	}
+
+	writeJSON(w, orders)
+}
+
+// handleActivePositions serves /v1/positions
+func (server *Server) handleActivePositions(w http.ResponseWriter) {
+	symbols := make([]string, 0, len(server.positions))
+	for symbol := range server.positions {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	positions := []position{}
+	for i, symbol := range symbols {
+		if server.positions[symbol] == 0 {
+			continue
+		}
+		var base float64
+		if trades := server.trades[symbol]; len(trades) > 0 {
+			base = trades[0].Price
+		}
+		positions = append(positions, position{
+			ID:        i + 1,
+			Symbol:    symbol,
+			Status:    "ACTIVE",
+			Base:      base,
+			Amount:    server.positions[symbol],
+			Timestamp: timestamp(time.Now()),
+		})
+	}
+
+	writeJSON(w, positions)
+}
+
+// newOrder validates and places an order, filling market orders immediately
+func (server *Server) newOrder(symbol string, amount, price float64, exchange, side, otype string) (*Order, string) {
+	if message := server.validate(symbol, amount, side); message != "" {
+		return nil, message
+	}
+
+	return server.place(symbol, amount, price, exchange, side, otype), ""
+}
+
+// validate returns the exchange's message rejecting an order, "" if it is valid
+func (server *Server) validate(symbol string, amount float64, side string) string {
+	if _, ok := server.trades[symbol]; !ok {
+		return msgUnknownSymbol
+	}
+	if amount < 0.01 {
+		return fmt.Sprintf(msgBadAmount, symbol)
+	}
+	if side != "buy" && side != "sell" {
+		return "Invalid side."
+	}
+
+	return ""
+}
+
+// place places a valid order, filling market orders immediately
+func (server *Server) place(symbol string, amount, price float64, exchange, side, otype string) *Order {
+	order := &Order{
+		ID:             server.nextID,
+		Symbol:         symbol,
+		Exchange:       exchange,
+		Side:           side,
+		Type:           otype,
+		Price:          price,
+		OriginalAmount: amount,
+		IsLive:         true,
+		Timestamp:      time.Now(),
+	}
+	server.nextID++
+	server.orders[order.ID] = order
+
+	if trades := server.trades[symbol]; strings.HasSuffix(otype, "market") && len(trades) > 0 {
+		server.fill(order, amount, trades[0].Price)
+	}
+
+	return order
+}
+
+// fill executes part of an order, updating position and public trades
+func (server *Server) fill(order *Order, amount, price float64) {
+	remaining := order.OriginalAmount - order.ExecutedAmount
+	if amount > remaining {
+		amount = remaining
+	}
+
+	order.AvgPrice = (order.AvgPrice*order.ExecutedAmount + price*amount) / (order.ExecutedAmount + amount)
+	order.ExecutedAmount += amount
+	if order.OriginalAmount-order.ExecutedAmount < 1e-9 {
+		order.IsLive = false
+	}
+
+	if order.Side == "buy" {
+		server.positions[order.Symbol] += amount
+		server.addTrade(order.Symbol, price, amount, "buy")
+	} else {
+		server.positions[order.Symbol] -= amount
+		server.addTrade(order.Symbol, price, amount, "sell")
+	}
+}
+
+// addTrade prepends a public trade for symbol
+func (server *Server) addTrade(symbol string, price, amount float64, ttype string) Trade {
+	trade := Trade{
+		Timestamp: int(time.Now().Unix()),
+		TID:       server.nextTID,
+		Price:     price,
+		Amount:    amount,
+		Exchange:  "bitfinex",
+		Type:      ttype,
+	}
+	server.nextTID++
+	server.trades[symbol] = append([]Trade{trade}, server.trades[symbol]...)
+
+	return trade
+}
+
+// liveOrders returns live orders sorted by ID
+func (server *Server) liveOrders() []Order {
+	var orders []Order
+	for _, order := range server.orders {
+		if order.IsLive {
+			orders = append(orders, *order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+
+	return orders
+}
+
+// statusOf converts an order to its wire format
+func statusOf(order *Order) orderStatus {
+	return orderStatus{
+		ID:              order.ID,
+		Symbol:          order.Symbol,
+		Exchange:        order.Exchange,
+		Price:           order.Price,
+		ExecutionPrice:  order.AvgPrice,
+		Side:            order.Side,
+		Type:            order.Type,
+		Timestamp:       timestamp(order.Timestamp),
+		IsLive:          order.IsLive,
+		IsCancelled:     order.IsCancelled,
+		OriginalAmount:  order.OriginalAmount,
+		RemainingAmount: order.OriginalAmount - order.ExecutedAmount,
+		ExecutedAmount:  order.ExecutedAmount,
+	}
+}
+
+// multiStatusOf converts an order to its multi order wire format
+func multiStatusOf(order *Order) multiOrderStatus {
+	status := "ACTIVE"
+	if !order.IsLive {
+		status = "EXECUTED"
+	}
+	amount := order.OriginalAmount - order.ExecutedAmount
+	if order.Side == "sell" {
+		amount = -amount
+	}
+
+	return multiOrderStatus{
+		ID:             order.ID,
+		Pair:           strings.ToUpper(order.Symbol),
+		Amount:         amount,
+		OriginalAmount: order.OriginalAmount,
+		Price:          order.Price,
+		AvgPrice:       order.AvgPrice,
+		Type:           strings.ToUpper(order.Type),
+		Status:         status,
+		CreatedAt:      order.Timestamp.UTC().Format(time.RFC3339),
+		UpdatedAt:      order.Timestamp.UTC().Format(time.RFC3339),
+	}
+}
+
+// bookSide returns aggregated price levels, best first
+func bookSide(levels map[float64]float64, limit int, descending bool) []bookItem {
+	items := []bookItem{}
+	for price, amount := range levels {
+		items = append(items, bookItem{price, amount, timestamp(time.Now())})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if descending {
+			return items[i].Price > items[j].Price
+		}
+		return items[i].Price < items[j].Price
+	})
+	if limit < len(items) {
+		items = items[:limit]
+	}
+
+	return items
+}
+
+// timestamp formats a time the way the exchange does
+func timestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 1, 64)
+}
+
+// writeJSON writes a successful JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an exchange error message
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{message})
+}
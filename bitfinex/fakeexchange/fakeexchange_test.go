@@ -0,0 +1,131 @@
+package fakeexchange_test
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/bitfinex/fakeexchange"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestAuthentication(t *testing.T) {
+	exchange := fakeexchange.New("key", "secret")
+	defer exchange.Close()
+
+	// Test bad key
+	_, err := bitfinex.New("badkey", "secret", bitfinex.BaseURL(exchange.URL)).ActivePositions()
+	if err == nil {
+		t.Fatal("Expected error on bad key")
+	}
+
+	// Test bad signature
+	_, err = bitfinex.New("key", "badsecret", bitfinex.BaseURL(exchange.URL)).ActivePositions()
+	if err == nil {
+		t.Fatal("Expected error on bad signature")
+	}
+
+	// Test good credentials
+	_, err = bitfinex.New("key", "secret", bitfinex.BaseURL(exchange.URL)).ActivePositions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchange.Requests("/v1/positions") != 3 {
+		t.Fatal("Expected three position requests")
+	}
+}
+
+func TestScriptedFailure(t *testing.T) {
+	exchange := fakeexchange.New("key", "secret")
+	defer exchange.Close()
+	exchange.AddTrade("btcusd", 250, 1)
+	client := bitfinex.New("key", "secret", bitfinex.BaseURL(exchange.URL))
+
+	exchange.Fail("/v1/order/new", http.StatusBadRequest, "Invalid order: not enough tradable balance")
+	_, err := client.NewOrder("btcusd", 1, 249, "bitfinex", "buy", "limit")
+	if !errors.Is(err, bitfinex.ErrInsufficientMargin) {
+		t.Fatal("Expected scripted error")
+	}
+
+	// Only the next request fails
+	order, err := client.NewOrder("btcusd", 1, 249, "bitfinex", "buy", "limit")
+	if err != nil || order.ID == 0 {
+		t.Fatal(err)
+	}
+	if len(exchange.Orders()) != 1 {
+		t.Fatal("Expected one live order")
+	}
+}
+
+func TestFill(t *testing.T) {
+	exchange := fakeexchange.New("key", "secret")
+	defer exchange.Close()
+	exchange.AddTrade("btcusd", 250, 1)
+	client := bitfinex.New("key", "secret", bitfinex.BaseURL(exchange.URL))
+
+	orders, err := client.MultipleNewOrders([]bitfinex.OrderParams{
+		{Symbol: "btcusd", Amount: 1, Price: 249, Exchange: "bitfinex", Side: "buy", Type: "limit"},
+		{Symbol: "btcusd", Amount: 1, Price: 251, Exchange: "bitfinex", Side: "sell", Type: "limit"},
+	})
+	if err != nil || len(orders.Orders) != 2 {
+		t.Fatal(err)
+	}
+
+	// Fill the whole bid and part of the ask
+	if err = exchange.Fill(orders.Orders[0].ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = exchange.Fill(orders.Orders[1].ID, 0.4); err != nil {
+		t.Fatal(err)
+	}
+	if err = exchange.Fill(orders.Orders[0].ID, 1); err == nil {
+		t.Fatal("Expected error filling a filled order")
+	}
+
+	if math.Abs(exchange.Position("btcusd")-0.6) > 0.000001 {
+		t.Fatal("Expected position of 0.6")
+	}
+	trades, err := client.Trades("btcusd", 10)
+	if err != nil || len(trades) != 3 || trades[0].Price != 251 {
+		t.Fatal("Expected fills in public trades")
+	}
+
+	book, err := client.Orderbook("btcusd", 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(book.Bids) != 0 || len(book.Asks) != 1 || math.Abs(book.Asks[0].Amount-0.6) > 0.000001 {
+		t.Fatal("Expected remaining ask in book")
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	exchange := fakeexchange.New("key", "secret")
+	defer exchange.Close()
+	exchange.AddTrade("btcusd", 250, 1)
+	client := bitfinex.New("key", "secret", bitfinex.BaseURL(exchange.URL))
+
+	// A bad replace leaves the old order live
+	order, err := client.NewOrder("btcusd", 1, 249, "bitfinex", "buy", "limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ReplaceOrder(order.ID, "btcusd", 0.001, 248, "bitfinex", "buy", "limit"); err == nil {
+		t.Fatal("Expected bad replace rejected")
+	}
+	if live, ok := exchange.Order(order.ID); !ok || !live.IsLive {
+		t.Fatalf("Expected old order live, got %+v", live)
+	}
+
+	// A batch with a bad order places none
+	_, err = client.MultipleNewOrders([]bitfinex.OrderParams{
+		{Symbol: "btcusd", Amount: 1, Price: 248, Exchange: "bitfinex", Side: "buy", Type: "limit"},
+		{Symbol: "btcusd", Amount: 1, Price: 252, Exchange: "bitfinex", Side: "short", Type: "limit"},
+	})
+	if err == nil {
+		t.Fatal("Expected bad batch rejected")
+	}
+	if orders := exchange.Orders(); len(orders) != 1 {
+		t.Fatalf("Expected only the first order, got %+v", orders)
+	}
+}
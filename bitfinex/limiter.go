@@ -0,0 +1,106 @@
+// Client-side rate limiting
+
+package bitfinex
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket shared by all copies of a Client
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum tokens in the bucket
+	tokens float64 // Tokens currently available
+	last   time.Time
+	wait   bool // Block until a token is available instead of failing
+	now    func() time.Time
+}
+
+// LimitError is returned when a non-blocking Limiter has no tokens left
+type LimitError struct {
+	Class string        // "public" or "authenticated"
+	Retry time.Duration // Time until a token is available
+}
+
+// NewLimiter allows requests per interval, in bursts of up to requests. If wait
+// is true calls block until a token is available, otherwise they fail with
+// LimitError. It returns nil, no limit, if requests is 0 or less.
+func NewLimiter(requests int, interval time.Duration, wait bool) *Limiter {
+	if requests <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		rate:   float64(requests) / interval.Seconds(),
+		burst:  float64(requests),
+		tokens: float64(requests),
+		last:   time.Now(),
+		wait:   wait,
+		now:    time.Now,
+	}
+}
+
+// Error describes the exhausted limit
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("bitfinex: %s request limit reached, retry in %v", err.Class, err.Retry)
+}
+
+// Is makes a LimitError match ErrRateLimited, and ErrRejected as it was never sent
+func (err *LimitError) Is(target error) bool {
+	return target == ErrRateLimited || target == ErrRejected
+}
+
+// Budget returns the number of tokens currently available
+func (limiter *Limiter) Budget() float64 {
+	if limiter == nil {
+		return math.Inf(1)
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	limiter.refill()
+	return limiter.tokens
+}
+
+// take removes a token, waiting for one if the limiter blocks
+func (limiter *Limiter) take(ctx context.Context, class string) error {
+	if limiter == nil {
+		return nil
+	}
+
+	for {
+		limiter.mu.Lock()
+		limiter.refill()
+		if limiter.tokens >= 1 {
+			limiter.tokens--
+			limiter.mu.Unlock()
+			return nil
+		}
+		retry := time.Duration((1 - limiter.tokens) / limiter.rate * float64(time.Second))
+		limiter.mu.Unlock()
+
+		if !limiter.wait {
+			return &LimitError{class, retry}
+		}
+
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// refill adds tokens for the time since the last refill
+func (limiter *Limiter) refill() {
+	now := limiter.now()
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+}
@@ -0,0 +1,119 @@
+package bitfinex
+
+import (
+	"bitmm/bitfinex/fakeexchange"
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter(2, time.Minute, false)
+	limiter.now = func() time.Time { return now }
+	limiter.last = now
+
+	// Test burst then limit
+	for i := 0; i < 2; i++ {
+		if err := limiter.take(context.Background(), "public"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := limiter.take(context.Background(), "public")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected LimitError, got %v", err)
+	}
+	if limitErr.Retry != 30*time.Second {
+		t.Fatalf("Expected retry in 30s, got %v", limitErr.Retry)
+	}
+
+	// Test refill
+	now = now.Add(45 * time.Second)
+	if math.Abs(limiter.Budget()-1.5) > 0.000001 {
+		t.Fatalf("Expected budget of 1.5, got %v", limiter.Budget())
+	}
+	now = now.Add(time.Hour)
+	if limiter.Budget() != 2 {
+		t.Fatal("Budget should not exceed burst")
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	limiter := NewLimiter(1, 100*time.Millisecond, true)
+	limiter.take(context.Background(), "public")
+
+	// Test blocking until a token is available
+	start := time.Now()
+	if err := limiter.take(context.Background(), "public"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Expected to wait for a token")
+	}
+
+	// Test giving up when the context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.take(ctx, "public"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	// A limit of 0 is no limiter, never waiting
+	limiter := NewLimiter(0, time.Minute, true)
+	if limiter != nil {
+		t.Fatalf("Expected no limiter, got %+v", limiter)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 100; i++ {
+		if err := limiter.take(ctx, "public"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !math.IsInf(limiter.Budget(), 1) {
+		t.Fatalf("Expected unlimited budget, got %v", limiter.Budget())
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	exchange := fakeexchange.New("key", "secret")
+	defer exchange.Close()
+	exchange.AddTrade("btcusd", 250, 1)
+
+	client := New("key", "secret", BaseURL(exchange.URL),
+		PublicLimit(NewLimiter(2, time.Minute, false)), AuthLimit(NewLimiter(1, time.Minute, false)))
+
+	// Copies of the client share limiters
+	copied := client
+	client.Trades("btcusd", 1)
+	copied.Trades("btcusd", 1)
+	if _, err := client.Trades("btcusd", 1); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected rate limited, got %v", err)
+	}
+	if exchange.Requests("/v1/trades") != 2 {
+		t.Fatal("Limited request should not reach the exchange")
+	}
+
+	// Authenticated requests have their own budget
+	public, authenticated := client.Budget()
+	if public >= 1 || authenticated != 1 {
+		t.Fatalf("Unexpected budget %v %v", public, authenticated)
+	}
+	if _, err := client.ActivePositions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ActivePositions(); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected rate limited, got %v", err)
+	}
+
+	// Unlimited clients report infinite budget
+	public, authenticated = New("key", "secret").Budget()
+	if !math.IsInf(public, 1) || !math.IsInf(authenticated, 1) {
+		t.Fatal("Expected infinite budget")
+	}
+}
@@ -0,0 +1,98 @@
+// Nonces for authenticated requests
+
+package bitfinex
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nonce generates strictly increasing nonces, safe for concurrent use. Nonces
+// follow the clock in nanoseconds but never repeat or go backwards.
+type Nonce struct {
+	mu   sync.Mutex
+	last int64  // Last nonce issued
+	path string // File the last nonce is persisted to, if any
+}
+
+// defaultNonce is used by clients not created with New
+var defaultNonce = NewNonce()
+
+// NewNonce returns a nonce source starting at the current time
+func NewNonce() *Nonce {
+	return &Nonce{}
+}
+
+// NewFileNonce returns a nonce source that persists the last nonce to path, so
+// a restart never reuses a nonce even if the clock has moved backwards
+func NewFileNonce(path string) (*Nonce, error) {
+	nonce := &Nonce{path: path}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		nonce.last, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nonce, nil
+}
+
+// NonceSource sets the nonce source, e.g. one shared with another Client using
+// the same key
+func NonceSource(nonce *Nonce) Option {
+	return func(client *Client) {
+		client.nonce = nonce
+	}
+}
+
+// Next returns the next nonce
+func (nonce *Nonce) Next() (string, error) {
+	nonce.mu.Lock()
+	defer nonce.mu.Unlock()
+
+	next := time.Now().UnixNano()
+	if next <= nonce.last {
+		next = nonce.last + 1
+	}
+
+	// Replace the file atomically so a crash can't leave a shorter nonce
+	if nonce.path != "" {
+		tmp := nonce.path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(next, 10)+"\n"), 0600); err != nil {
+			return "", err
+		}
+		if err := os.Rename(tmp, nonce.path); err != nil {
+			return "", err
+		}
+	}
+	nonce.last = next
+
+	return strconv.FormatInt(next, 10), nil
+}
+
+// nextNonce waits for the authenticated request budget and returns a nonce.
+// Nonces increase in the order they are taken, but requests sent concurrently
+// may still reach the exchange out of order.
+func (client Client) nextNonce(ctx context.Context) (string, error) {
+	err := client.authLimit.take(ctx, "authenticated")
+	if err != nil {
+		return "", err
+	}
+
+	nonce := client.nonce
+	if nonce == nil {
+		nonce = defaultNonce
+	}
+
+	return nonce.Next()
+}
@@ -0,0 +1,89 @@
+package bitfinex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNonceConcurrent(t *testing.T) {
+	nonce := NewNonce()
+
+	var wg sync.WaitGroup
+	results := make([][]int64, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				next, err := nonce.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.ParseInt(next, 10, 64)
+				results[i] = append(results[i], n)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int64]bool)
+	for _, result := range results {
+		for j, n := range result {
+			if seen[n] {
+				t.Fatalf("Nonce %d issued twice", n)
+			}
+			seen[n] = true
+			if j > 0 && n <= result[j-1] {
+				t.Fatal("Nonces not increasing")
+			}
+		}
+	}
+}
+
+func TestFileNonce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nonce")
+
+	// Simulate a previous run with a clock an hour ahead
+	ahead := time.Now().Add(time.Hour).UnixNano()
+	ioutil.WriteFile(path, []byte(strconv.FormatInt(ahead, 10)), 0600)
+
+	nonce, err := NewFileNonce(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := nonce.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := strconv.ParseInt(next, 10, 64); n <= ahead {
+		t.Fatal("Nonce should continue from persisted value")
+	}
+
+	// Test the new value is persisted for the next run
+	restarted, err := NewFileNonce(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.FormatInt(restarted.last, 10) != next {
+		t.Fatal("Last nonce not persisted")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("Nonce file should be replaced, not left half written")
+	}
+
+	// Test a missing file starts from the clock
+	if _, err = NewFileNonce(filepath.Join(dir, "missing")); err != nil {
+		t.Fatal(err)
+	}
+}
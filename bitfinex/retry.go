@@ -0,0 +1,73 @@
+// Retries for idempotent requests
+
+package bitfinex
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls retries of idempotent requests (market data, order
+// status, positions, active orders and CancelAll). Orders are never retried.
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts including the first, no retries if < 2
+	BaseDelay   time.Duration // Delay before the first retry, doubled for each retry
+	MaxDelay    time.Duration // Maximum delay between attempts, no maximum if 0
+	Jitter      float64       // Fraction of each delay that is randomized, 0 to 1
+}
+
+// errNotCancelled lets CancelAll retry when the exchange does not confirm
+var errNotCancelled = errors.New("bitfinex: orders not cancelled")
+
+// retry calls attempt until it succeeds, fails permanently or runs out of attempts
+func (client Client) retry(ctx context.Context, attempt func() error) error {
+	policy := client.retryPolicy
+
+	err := attempt()
+	for i := 1; i < policy.MaxAttempts && retryable(err); i++ {
+		timer := time.NewTimer(policy.delay(i))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		err = attempt()
+	}
+
+	return err
+}
+
+// delay returns the backoff before retry number n, starting at 1
+func (policy RetryPolicy) delay(n int) time.Duration {
+	delay := policy.BaseDelay << uint(n-1)
+	if policy.MaxDelay > 0 && (delay > policy.MaxDelay || delay <= 0) {
+		delay = policy.MaxDelay
+	}
+
+	return delay - time.Duration(policy.Jitter*rand.Float64()*float64(delay))
+}
+
+// retryable reports whether a failed request may succeed if sent again
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500 || apiErr.Err != nil ||
+			errors.Is(apiErr, ErrRateLimited) || errors.Is(apiErr, ErrInvalidNonce)
+	}
+
+	// Network errors and unconfirmed cancellations
+	return true
+}
@@ -0,0 +1,74 @@
+package bitfinex
+
+import (
+	"bitmm/bitfinex/fakeexchange"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, delay := range expected {
+		if policy.delay(i+1) != delay {
+			t.Fatalf("Retry %d: expected %v, got %v", i+1, delay, policy.delay(i+1))
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.delay(2)
+		if delay < 100*time.Millisecond || delay > 200*time.Millisecond {
+			t.Fatalf("Jittered delay %v out of range", delay)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	exchange := fakeexchange.New("key", "secret")
+	defer exchange.Close()
+	exchange.AddTrade("btcusd", 250, 1)
+	client := New("key", "secret", BaseURL(exchange.URL),
+		Retry(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}))
+
+	// Test recovery from transient errors
+	exchange.Fail("/v1/positions", http.StatusBadGateway, "")
+	exchange.Fail("/v1/positions", http.StatusTooManyRequests, "ERR_RATE_LIMIT")
+	if _, err := client.ActivePositions(); err != nil {
+		t.Fatal(err)
+	}
+	if exchange.Requests("/v1/positions") != 3 {
+		t.Fatal("Expected three position requests")
+	}
+
+	// Test giving up after max attempts
+	for i := 0; i < 3; i++ {
+		exchange.Fail("/v1/order/cancel/all", http.StatusServiceUnavailable, "")
+	}
+	if _, err := client.CancelAll(); err == nil {
+		t.Fatal("Expected error after max attempts")
+	}
+	if exchange.Requests("/v1/order/cancel/all") != 3 {
+		t.Fatal("Expected three cancel requests")
+	}
+
+	// Test permanent errors are not retried
+	exchange.Fail("/v1/orders", http.StatusBadRequest, "Invalid X-BFX-SIGNATURE.")
+	if _, err := client.ActiveOrders(); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Expected auth error, got %v", err)
+	}
+	if exchange.Requests("/v1/orders") != 1 {
+		t.Fatal("Auth error should not be retried")
+	}
+
+	// Test orders are never retried
+	exchange.Fail("/v1/order/new", http.StatusBadGateway, "")
+	if _, err := client.NewOrder("btcusd", 1, 249, "bitfinex", "buy", "limit"); err == nil {
+		t.Fatal("Expected error on new order")
+	}
+	if exchange.Requests("/v1/order/new") != 1 {
+		t.Fatal("New order should not be retried")
+	}
+}
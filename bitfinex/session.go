@@ -0,0 +1,279 @@
+// Bitfinex authenticated websocket stream
+
+package bitfinex
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Session streams our own orders, executions and positions over an
+// authenticated websocket connection, reconnecting whenever it fails or stalls.
+// Snapshots of live orders and positions follow every (re)connection.
+type Session struct {
+	URL              string        // Websocket URL
+	HeartbeatTimeout time.Duration // Reconnect if nothing is received for this long
+	ReconnectDelay   time.Duration // Delay before reconnecting, doubled up to a minute
+
+	Orders    chan OrderEvent    // Order snapshots and updates, dropped if not read
+	Fills     chan Fill          // Executions of our orders
+	Positions chan PositionEvent // Position snapshots and updates, dropped if not read
+	Errors    chan error         // Connection and order problems, dropped if not read
+
+	client Client
+}
+
+// OrderEvent contains orders from the authenticated channel
+type OrderEvent struct {
+	Snapshot bool    // True if Orders are all live orders, replacing any known
+	Orders   []Order // New, updated or closed orders
+}
+
+// Fill is an execution of one of our orders
+type Fill struct {
+	ID          int     // Trade ID
+	OrderID     int     // ID of the order that was filled
+	Symbol      string  // Symbol, e.g. "btcusd"
+	Timestamp   float64 // Execution time in seconds
+	Amount      float64 // Executed amount, positive for buys and negative for sells
+	Price       float64 // Execution price
+	Maker       bool    // True if the order was resting on the book
+	Fee         float64 // Fee, negative when paid
+	FeeCurrency string  // Currency of the fee, e.g. "USD"
+}
+
+// PositionEvent contains positions from the authenticated channel
+type PositionEvent struct {
+	Snapshot  bool      // True if Positions are all open positions, replacing any known
+	Positions Positions // New, updated or closed positions
+}
+
+// NewSession returns a session authenticating with client's credentials and
+// nonce source, using url, WebsocketURL if empty
+func NewSession(client Client, url string) *Session {
+	if url == "" {
+		url = WebsocketURL
+	}
+
+	return &Session{
+		URL:              url,
+		HeartbeatTimeout: 30 * time.Second,
+		ReconnectDelay:   time.Second,
+		Orders:           make(chan OrderEvent, 100),
+		Fills:            make(chan Fill, 100),
+		Positions:        make(chan PositionEvent, 100),
+		Errors:           make(chan error, 10),
+		client:           client,
+	}
+}
+
+// Run connects and delivers events until ctx is done
+func (session *Session) Run(ctx context.Context) error {
+	return reconnect(ctx, session.ReconnectDelay, session.report, session.run)
+}
+
+// run authenticates a single connection and handles it until it fails
+func (session *Session) run(ctx context.Context) error {
+	nonce, err := session.client.nextNonce(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Signature = HMAC-SHA384("AUTH" + nonce, api-secret) as hexadecimal
+	payload := "AUTH" + nonce
+	h := hmac.New(sha512.New384, []byte(session.client.APISecret))
+	h.Write([]byte(payload))
+
+	auth := struct {
+		Event   string `json:"event"`
+		APIKey  string `json:"apiKey"`
+		Sig     string `json:"authSig"`
+		Payload string `json:"authPayload"`
+		Nonce   string `json:"authNonce"`
+	}{"auth", session.client.APIKey, hex.EncodeToString(h.Sum(nil)), payload, nonce}
+
+	return serve(ctx, session.URL, session.HeartbeatTimeout, []interface{}{auth}, session.handle)
+}
+
+// handle processes a single message
+func (session *Session) handle(ctx context.Context, data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var e event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.Event == "auth" && e.Status != "OK" {
+			return fmt.Errorf("bitfinex: websocket authentication failed: %s", e.Msg)
+		}
+		if e.Event == "info" && e.Code == 20051 {
+			return fmt.Errorf("bitfinex: websocket server requested reconnect")
+		}
+		return nil
+	}
+
+	var message []interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	if len(message) < 3 || number(message, 0) != 0 {
+		return nil
+	}
+	kind, _ := message[1].(string)
+	item, _ := message[2].([]interface{})
+
+	switch kind {
+	case "os":
+		orders := make([]Order, 0, len(item))
+		for _, o := range item {
+			if o, ok := o.([]interface{}); ok {
+				orders = append(orders, parseOrder(o))
+			}
+		}
+		session.sendOrders(OrderEvent{true, orders})
+	case "on", "ou", "oc":
+		session.sendOrders(OrderEvent{false, []Order{parseOrder(item)}})
+	case "tu":
+		fill := Fill{
+			ID:          int(number(item, 0)),
+			Symbol:      symbolOf(item, 1),
+			Timestamp:   number(item, 2) / 1000,
+			OrderID:     int(number(item, 3)),
+			Amount:      number(item, 4),
+			Price:       number(item, 5),
+			Maker:       number(item, 8) == 1,
+			Fee:         number(item, 9),
+			FeeCurrency: text(item, 10),
+		}
+		select {
+		case session.Fills <- fill:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	case "ps":
+		positions := make(Positions, 0, len(item))
+		for _, p := range item {
+			if p, ok := p.([]interface{}); ok {
+				positions = append(positions, parsePosition(p))
+			}
+		}
+		session.sendPositions(PositionEvent{true, positions})
+	case "pn", "pu", "pc":
+		position := parsePosition(item)
+		if kind == "pc" {
+			position.Amount = 0
+		}
+		session.sendPositions(PositionEvent{false, Positions{position}})
+	case "n":
+		// Notification, e.g. a rejected order: [MTS, TYPE, ID, null, INFO, CODE, STATUS, TEXT]
+		if text(item, 6) == "ERROR" || text(item, 6) == "FAILURE" {
+			session.report(fmt.Errorf("bitfinex: %s: %s", text(item, 1), text(item, 7)))
+		}
+	}
+
+	return nil
+}
+
+// sendOrders delivers an order event if there is room, so an unread channel
+// can't hold up fills
+func (session *Session) sendOrders(e OrderEvent) {
+	select {
+	case session.Orders <- e:
+	default:
+	}
+}
+
+// sendPositions delivers a position event if there is room, so an unread
+// channel can't hold up fills
+func (session *Session) sendPositions(e PositionEvent) {
+	select {
+	case session.Positions <- e:
+	default:
+	}
+}
+
+// report sends an error if anyone is listening
+func (session *Session) report(err error) {
+	select {
+	case session.Errors <- err:
+	default:
+	}
+}
+
+// parseOrder converts a websocket order [ID, GID, CID, SYMBOL, MTS_CREATE,
+// MTS_UPDATE, AMOUNT, AMOUNT_ORIG, TYPE, TYPE_PREV, _, _, FLAGS, STATUS, _, _,
+// PRICE, PRICE_AVG, ...] to an Order
+func parseOrder(o []interface{}) Order {
+	amount, original := number(o, 6), number(o, 7)
+	status := text(o, 13)
+
+	order := Order{
+		ID:              int(number(o, 0)),
+		Symbol:          symbolOf(o, 3),
+		Exchange:        "bitfinex",
+		Timestamp:       number(o, 4) / 1000,
+		Type:            strings.ToLower(text(o, 8)),
+		Price:           number(o, 16),
+		ExecutionPrice:  number(o, 17),
+		AvgPrice:        number(o, 17),
+		Status:          status,
+		Side:            "buy",
+		OriginalAmount:  original,
+		RemainingAmount: amount,
+		IsLive:          strings.HasPrefix(status, "ACTIVE") || strings.HasPrefix(status, "PARTIALLY FILLED"),
+		IsCancelled:     strings.HasPrefix(status, "CANCELED"),
+	}
+	if original < 0 {
+		order.Side = "sell"
+		order.OriginalAmount = -original
+		order.RemainingAmount = -amount
+	}
+	order.ExecutedAmount = order.OriginalAmount - order.RemainingAmount
+	order.Amount = order.RemainingAmount
+
+	return order
+}
+
+// parsePosition converts a websocket position [SYMBOL, STATUS, AMOUNT,
+// BASE_PRICE, MARGIN_FUNDING, MARGIN_FUNDING_TYPE, PL, ...] to a Position
+func parsePosition(p []interface{}) Position {
+	return Position{
+		Symbol: symbolOf(p, 0),
+		Status: text(p, 1),
+		Amount: number(p, 2),
+		Base:   number(p, 3),
+		Swap:   number(p, 4),
+		PL:     number(p, 6),
+	}
+}
+
+// number returns element i of a websocket array as a number, 0 if missing
+func number(a []interface{}, i int) float64 {
+	if i >= len(a) {
+		return 0
+	}
+	n, _ := a[i].(float64)
+
+	return n
+}
+
+// text returns element i of a websocket array as a string, "" if missing
+func text(a []interface{}, i int) string {
+	if i >= len(a) {
+		return ""
+	}
+	s, _ := a[i].(string)
+
+	return s
+}
+
+// symbolOf returns element i of a websocket array as a symbol, e.g. "tBTCUSD" as "btcusd"
+func symbolOf(a []interface{}, i int) string {
+	return strings.ToLower(strings.TrimPrefix(text(a, i), "t"))
+}
@@ -0,0 +1,164 @@
+package bitfinex
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSession(t *testing.T) {
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		var auth struct {
+			Event   string `json:"event"`
+			APIKey  string `json:"apiKey"`
+			Sig     string `json:"authSig"`
+			Payload string `json:"authPayload"`
+			Nonce   string `json:"authNonce"`
+		}
+		if err = conn.ReadJSON(&auth); err != nil {
+			t.Error(err)
+			return
+		}
+		h := hmac.New(sha512.New384, []byte("secret"))
+		h.Write([]byte(auth.Payload))
+		if auth.Event != "auth" || auth.APIKey != "key" || auth.Sig != hex.EncodeToString(h.Sum(nil)) ||
+			auth.Payload != "AUTH"+auth.Nonce {
+			send(conn, `{"event":"auth","status":"FAILED","chanId":0,"code":10100,"msg":"apikey: invalid"}`)
+			return
+		}
+
+		send(conn,
+			`{"event":"auth","status":"OK","chanId":0,"userId":1}`,
+			`[0,"ps",[["tBTCUSD","ACTIVE",0.5,249.5,0,0,1.25,0.01,0,1]]]`,
+			`[0,"os",[[10,null,1,"tBTCUSD",1444266681000,1444266681000,-1,-1,"LIMIT",null,null,null,0,"ACTIVE",null,null,251,0]]]`,
+			`[0,"hb"]`,
+			`[0,"te",[20,"tBTCUSD",1444266682000,10,-0.4,251,"LIMIT",251,1,null,null]]`,
+			`[0,"tu",[20,"tBTCUSD",1444266682000,10,-0.4,251,"LIMIT",251,1,-0.05,"USD"]]`,
+			`[0,"ou",[10,null,1,"tBTCUSD",1444266681000,1444266682000,-0.6,-1,"LIMIT",null,null,null,0,"PARTIALLY FILLED @ 251.0(-0.4)",null,null,251,251]]`,
+			`[0,"pu",["tBTCUSD","ACTIVE",0.1,249.5,0,0,0.9,0.01,0,1]]`,
+			`[0,"n",[1444266683000,"on-req",null,null,null,null,"ERROR","Invalid order: not enough tradable balance"]]`,
+		)
+		time.Sleep(time.Second)
+	}))
+	defer server.Close()
+
+	session := NewSession(New("key", "secret"), "ws"+strings.TrimPrefix(server.URL, "http"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go session.Run(ctx)
+
+	// Test snapshots
+	positions := <-session.Positions
+	if !positions.Snapshot || len(positions.Positions) != 1 || positions.Positions[0].Symbol != "btcusd" ||
+		positions.Positions[0].Amount != 0.5 || positions.Positions[0].PL != 1.25 {
+		t.Fatalf("Unexpected positions %+v", positions)
+	}
+	orders := <-session.Orders
+	if !orders.Snapshot || len(orders.Orders) != 1 {
+		t.Fatalf("Unexpected orders %+v", orders)
+	}
+	order := orders.Orders[0]
+	if order.ID != 10 || order.Side != "sell" || order.OriginalAmount != 1 || !order.IsLive || order.Price != 251 {
+		t.Fatalf("Unexpected order %+v", order)
+	}
+
+	// Test fill and updates
+	fill := <-session.Fills
+	if fill.OrderID != 10 || fill.Amount != -0.4 || fill.Price != 251 || !fill.Maker || fill.Fee != -0.05 || fill.Symbol != "btcusd" {
+		t.Fatalf("Unexpected fill %+v", fill)
+	}
+	orders = <-session.Orders
+	order = orders.Orders[0]
+	if orders.Snapshot || !order.IsLive || math.Abs(order.ExecutedAmount-0.4) > 0.000001 || math.Abs(order.RemainingAmount-0.6) > 0.000001 {
+		t.Fatalf("Unexpected order update %+v", order)
+	}
+	positions = <-session.Positions
+	if positions.Snapshot || positions.Positions[0].Amount != 0.1 {
+		t.Fatalf("Unexpected position update %+v", positions)
+	}
+
+	// Test order error notification
+	if err := <-session.Errors; err == nil || !strings.Contains(err.Error(), "not enough tradable balance") {
+		t.Fatalf("Expected order error, got %v", err)
+	}
+}
+
+func TestSessionAuthFailure(t *testing.T) {
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+		send(conn, `{"event":"auth","status":"FAILED","chanId":0,"code":10100,"msg":"apikey: invalid"}`)
+		time.Sleep(time.Second)
+	}))
+	defer server.Close()
+
+	session := NewSession(New("badkey", "secret"), "ws"+strings.TrimPrefix(server.URL, "http"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go session.Run(ctx)
+
+	if err := <-session.Errors; err == nil || !strings.Contains(err.Error(), "apikey: invalid") {
+		t.Fatalf("Expected authentication failure, got %v", err)
+	}
+}
+
+func TestSessionUnreadOrders(t *testing.T) {
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+		send(conn, `{"event":"auth","status":"OK","chanId":0,"userId":1}`)
+
+		// More order and position updates than the channels hold, then a fill
+		for i := 0; i < 150; i++ {
+			send(conn,
+				`[0,"ou",[10,null,1,"tBTCUSD",1444266681000,1444266682000,-1,-1,"LIMIT",null,null,null,0,"ACTIVE",null,null,251,0]]`,
+				`[0,"pu",["tBTCUSD","ACTIVE",0.1,249.5,0,0,0.9,0.01,0,1]]`,
+			)
+		}
+		send(conn, `[0,"tu",[20,"tBTCUSD",1444266682000,10,-0.4,251,"LIMIT",251,1,-0.05,"USD"]]`)
+		time.Sleep(time.Second)
+	}))
+	defer server.Close()
+
+	session := NewSession(New("key", "secret"), "ws"+strings.TrimPrefix(server.URL, "http"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go session.Run(ctx)
+
+	// Fills arrive though Orders and Positions are never read
+	select {
+	case fill := <-session.Fills:
+		if fill.OrderID != 10 {
+			t.Fatalf("Unexpected fill %+v", fill)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected fill despite unread order updates")
+	}
+}
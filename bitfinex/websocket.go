@@ -0,0 +1,525 @@
+// Bitfinex websocket market data
+
+package bitfinex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Bitfinex websocket URL
+const (
+	WebsocketURL = "wss://api.bitfinex.com/ws/2"
+)
+
+// Websocket configuration flags adding the exchange time and a sequence number
+// to every message and a checksum after every book update
+const (
+	flagTimestamp = 32768
+	flagSeqAll    = 65536
+	flagChecksum  = 131072
+)
+
+// Stream receives market data over the websocket API, reconnecting and
+// resubscribing whenever the connection fails, stalls or skips a message.
+// Snapshot events follow every (re)subscription.
+type Stream struct {
+	URL              string        // Websocket URL
+	HeartbeatTimeout time.Duration // Reconnect if nothing is received for this long
+	ReconnectDelay   time.Duration // Delay before reconnecting, doubled up to a minute
+
+	Trades  chan TradeEvent  // Trades on subscribed symbols
+	Tickers chan TickerEvent // Tickers on subscribed symbols
+	Books   chan BookEvent   // Orderbook snapshots and updates on subscribed symbols
+	Errors  chan error       // Connection problems, dropped if not read
+
+	mu            sync.Mutex
+	resync        chan struct{}
+	subscriptions []subscription
+	channels      map[int]subscription // Subscriptions by channel ID on the current connection
+	seq           int64                // Last sequence number on the current connection
+}
+
+// TradeEvent contains trades from the trades channel
+type TradeEvent struct {
+	Symbol    string  // Symbol, e.g. "btcusd"
+	Snapshot  bool    // True for the recent trades sent on subscribing
+	Trades    Trades  // Trades, newest first
+	Timestamp float64 // Exchange time the message was sent in seconds, 0 if unknown
+}
+
+// TickerEvent contains a ticker update
+type TickerEvent struct {
+	Symbol          string  `json:"symbol"`            // Symbol, e.g. "btcusd"
+	Bid             float64 `json:"bid"`               // Best bid price
+	BidSize         float64 `json:"bid_size"`          // Total size at the best bid
+	Ask             float64 `json:"ask"`               // Best ask price
+	AskSize         float64 `json:"ask_size"`          // Total size at the best ask
+	DailyChange     float64 `json:"daily_change"`      // Price change over the last day
+	DailyChangePerc float64 `json:"daily_change_perc"` // Relative price change over the last day
+	LastPrice       float64 `json:"last_price"`        // Last traded price
+	Volume          float64 `json:"volume"`            // Volume over the last day
+	High            float64 `json:"high"`              // High over the last day
+	Low             float64 `json:"low"`               // Low over the last day
+	Timestamp       float64 `json:"timestamp"`         // Exchange time in seconds, 0 if unknown
+}
+
+// BookEvent contains orderbook levels or a checksum from the book channel
+type BookEvent struct {
+	Symbol     string      `json:"symbol"`                // Symbol, e.g. "btcusd"
+	Snapshot   bool        `json:"snapshot,omitempty"`    // True if Levels replace the whole book
+	Levels     []BookLevel `json:"levels,omitempty"`      // Changed levels
+	IsChecksum bool        `json:"is_checksum,omitempty"` // True if the event only carries Checksum
+	Checksum   int32       `json:"checksum,omitempty"`    // CRC32 of the top 25 levels after preceding updates
+	Timestamp  float64     `json:"timestamp"`             // Exchange time in seconds, 0 if unknown
+}
+
+// BookLevel is an aggregated orderbook price level
+type BookLevel struct {
+	Price  float64 `json:"price"`  // Level price
+	Count  int     `json:"count"`  // Number of orders at the level, 0 if the level was removed
+	Amount float64 `json:"amount"` // Total size, positive for bids and negative for asks
+}
+
+// GapError reports a skipped sequence number, after which the stream resubscribes
+type GapError struct {
+	Expected int64 // Expected sequence number
+	Received int64 // Received sequence number
+}
+
+// Errors reported when the stream reconnects
+var (
+	ErrHeartbeat = errors.New("bitfinex: websocket heartbeat timeout")
+	ErrResync    = errors.New("bitfinex: websocket resync requested")
+)
+
+// subscription is a channel subscription request
+type subscription struct {
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+	Symbol  string `json:"symbol"`
+	Prec    string `json:"prec,omitempty"`
+	Len     string `json:"len,omitempty"`
+}
+
+// event is a websocket event message
+type event struct {
+	Event   string `json:"event"`
+	Channel string `json:"channel"`
+	ChanID  int    `json:"chanId"`
+	Symbol  string `json:"symbol"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+}
+
+// NewStream returns a stream using url, WebsocketURL if empty
+func NewStream(url string) *Stream {
+	if url == "" {
+		url = WebsocketURL
+	}
+
+	return &Stream{
+		URL:              url,
+		HeartbeatTimeout: 30 * time.Second,
+		ReconnectDelay:   time.Second,
+		Trades:           make(chan TradeEvent, 100),
+		Tickers:          make(chan TickerEvent, 100),
+		Books:            make(chan BookEvent, 100),
+		Errors:           make(chan error, 10),
+		resync:           make(chan struct{}, 1),
+	}
+}
+
+// Error describes the gap
+func (err *GapError) Error() string {
+	return fmt.Sprintf("bitfinex: websocket sequence gap, expected %d received %d", err.Expected, err.Received)
+}
+
+// SubscribeTrades subscribes to trades on symbol
+func (stream *Stream) SubscribeTrades(symbol string) {
+	stream.subscribe(subscription{Channel: "trades", Symbol: symbol})
+}
+
+// SubscribeTicker subscribes to the ticker for symbol
+func (stream *Stream) SubscribeTicker(symbol string) {
+	stream.subscribe(subscription{Channel: "ticker", Symbol: symbol})
+}
+
+// SubscribeBook subscribes to raw price levels for symbol, length 25 or 100
+func (stream *Stream) SubscribeBook(symbol string, length int) {
+	stream.subscribe(subscription{Channel: "book", Symbol: symbol, Prec: "P0", Len: strconv.Itoa(length)})
+}
+
+// Run connects and delivers events until ctx is done
+func (stream *Stream) Run(ctx context.Context) error {
+	return reconnect(ctx, stream.ReconnectDelay, stream.report, stream.run)
+}
+
+// Resync reconnects and resubscribes, so new snapshots follow
+func (stream *Stream) Resync() {
+	select {
+	case stream.resync <- struct{}{}:
+	default: // Already requested
+	}
+}
+
+// subscribe adds a subscription, sent on each connection
+func (stream *Stream) subscribe(sub subscription) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	sub.Event = "subscribe"
+	sub.Symbol = "t" + strings.ToUpper(sub.Symbol)
+	stream.subscriptions = append(stream.subscriptions, sub)
+}
+
+// run handles a single connection until it fails
+func (stream *Stream) run(ctx context.Context) error {
+	stream.mu.Lock()
+	stream.channels = make(map[int]subscription)
+	stream.seq = 0
+	messages := []interface{}{struct {
+		Event string `json:"event"`
+		Flags int    `json:"flags"`
+	}{"conf", flagTimestamp | flagSeqAll | flagChecksum}}
+	for _, sub := range stream.subscriptions {
+		messages = append(messages, sub)
+	}
+	stream.mu.Unlock()
+
+	// Drop the connection if a resync is requested
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	requested := make(chan struct{})
+	go func() {
+		select {
+		case <-stream.resync:
+			close(requested)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := serve(ctx, stream.URL, stream.HeartbeatTimeout, messages, stream.handle)
+	select {
+	case <-requested:
+		return ErrResync
+	default:
+		return err
+	}
+}
+
+// reconnect runs connection until ctx is done, reporting each failure and
+// backing off while connections keep failing quickly
+func reconnect(ctx context.Context, delay time.Duration, report func(error),
+	connection func(context.Context) error) error {
+	initial := delay
+	for {
+		start := time.Now()
+		err := connection(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		report(err)
+
+		if time.Since(start) > time.Minute {
+			delay = initial
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// serve dials url, sends messages and passes everything received to handle
+// until the connection fails or is quiet for heartbeat
+func serve(ctx context.Context, url string, heartbeat time.Duration, messages []interface{},
+	handle func(context.Context, []byte) error) error {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock reads when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for _, message := range messages {
+		if err = conn.WriteJSON(message); err != nil {
+			return err
+		}
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(heartbeat))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				return ErrHeartbeat
+			}
+			return err
+		}
+
+		if err = handle(ctx, data); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a single message
+func (stream *Stream) handle(ctx context.Context, data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var e event
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		return stream.handleEvent(e)
+	}
+
+	var message []json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	if len(message) < 2 {
+		return fmt.Errorf("bitfinex: unexpected websocket message %s", data)
+	}
+
+	var chanID int
+	if err := json.Unmarshal(message[0], &chanID); err != nil {
+		return err
+	}
+
+	// Take the exchange time in milliseconds added by flagTimestamp, which
+	// follows the sequence number
+	var mts float64
+	if len(message) > 3 && json.Unmarshal(message[len(message)-1], &mts) == nil && mts > 1e12 {
+		message = message[:len(message)-1]
+	} else {
+		mts = 0
+	}
+
+	// Check the sequence number added by flagSeqAll
+	var seq int64
+	if err := json.Unmarshal(message[len(message)-1], &seq); err != nil {
+		return fmt.Errorf("bitfinex: missing websocket sequence number in %s", data)
+	}
+	message = message[1 : len(message)-1]
+	if err := stream.checkSeq(seq); err != nil {
+		return err
+	}
+
+	// Heartbeat
+	var kind string
+	if json.Unmarshal(message[0], &kind) == nil && kind == "hb" {
+		return nil
+	}
+
+	stream.mu.Lock()
+	sub, ok := stream.channels[chanID]
+	stream.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	symbol := strings.ToLower(strings.TrimPrefix(sub.Symbol, "t"))
+
+	switch sub.Channel {
+	case "trades":
+		return stream.handleTrades(ctx, symbol, message, mts/1000)
+	case "ticker":
+		return stream.handleTicker(ctx, symbol, message, mts/1000)
+	case "book":
+		return stream.handleBook(ctx, symbol, message, mts/1000)
+	}
+
+	return nil
+}
+
+// handleEvent processes an event message
+func (stream *Stream) handleEvent(e event) error {
+	switch e.Event {
+	case "subscribed":
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		for _, sub := range stream.subscriptions {
+			if sub.Channel == e.Channel && sub.Symbol == e.Symbol {
+				stream.channels[e.ChanID] = sub
+			}
+		}
+	case "error":
+		stream.report(fmt.Errorf("bitfinex: websocket error %d: %s", e.Code, e.Msg))
+	case "info":
+		// Exchange asks clients to reconnect, e.g. before maintenance
+		if e.Code == 20051 {
+			return errors.New("bitfinex: websocket server requested reconnect")
+		}
+	}
+
+	return nil
+}
+
+// handleTrades processes a trades snapshot or update
+func (stream *Stream) handleTrades(ctx context.Context, symbol string, message []json.RawMessage, timestamp float64) error {
+	var kind string
+	if json.Unmarshal(message[0], &kind) == nil {
+		// Only "te" is needed, "tu" repeats it with the trade ID confirmed
+		if kind != "te" || len(message) < 2 {
+			return nil
+		}
+		var trade []float64
+		if err := json.Unmarshal(message[1], &trade); err != nil {
+			return err
+		}
+		select {
+		case stream.Trades <- TradeEvent{symbol, false, Trades{parseTrade(trade)}, timestamp}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var snapshot [][]float64
+	if err := json.Unmarshal(message[0], &snapshot); err != nil {
+		return err
+	}
+	trades := make(Trades, 0, len(snapshot))
+	for _, trade := range snapshot {
+		trades = append(trades, parseTrade(trade))
+	}
+	select {
+	case stream.Trades <- TradeEvent{symbol, true, trades, timestamp}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleTicker processes a ticker update
+func (stream *Stream) handleTicker(ctx context.Context, symbol string, message []json.RawMessage, timestamp float64) error {
+	var t []float64
+	if err := json.Unmarshal(message[0], &t); err != nil {
+		return err
+	}
+	if len(t) < 10 {
+		return fmt.Errorf("bitfinex: short ticker message")
+	}
+	select {
+	case stream.Tickers <- TickerEvent{symbol, t[0], t[1], t[2], t[3], t[4], t[5], t[6], t[7], t[8], t[9], timestamp}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleBook processes a book snapshot or update
+func (stream *Stream) handleBook(ctx context.Context, symbol string, message []json.RawMessage, timestamp float64) error {
+	var kind string
+	if json.Unmarshal(message[0], &kind) == nil {
+		if kind != "cs" || len(message) < 2 {
+			return nil
+		}
+		var checksum int32
+		if err := json.Unmarshal(message[1], &checksum); err != nil {
+			return err
+		}
+		select {
+		case stream.Books <- BookEvent{Symbol: symbol, IsChecksum: true, Checksum: checksum, Timestamp: timestamp}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var level []float64
+	if json.Unmarshal(message[0], &level) == nil && len(level) == 3 {
+		select {
+		case stream.Books <- BookEvent{Symbol: symbol, Levels: []BookLevel{{level[0], int(level[1]), level[2]}}, Timestamp: timestamp}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var snapshot [][]float64
+	if err := json.Unmarshal(message[0], &snapshot); err != nil {
+		return err
+	}
+	levels := make([]BookLevel, 0, len(snapshot))
+	for _, level := range snapshot {
+		if len(level) == 3 {
+			levels = append(levels, BookLevel{level[0], int(level[1]), level[2]})
+		}
+	}
+	select {
+	case stream.Books <- BookEvent{Symbol: symbol, Snapshot: true, Levels: levels, Timestamp: timestamp}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkSeq verifies a message follows the previous one
+func (stream *Stream) checkSeq(seq int64) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if stream.seq != 0 && seq != stream.seq+1 {
+		return &GapError{stream.seq + 1, seq}
+	}
+	stream.seq = seq
+
+	return nil
+}
+
+// report sends an error if anyone is listening
+func (stream *Stream) report(err error) {
+	select {
+	case stream.Errors <- err:
+	default:
+	}
+}
+
+// parseTrade converts a websocket trade [ID, MTS, AMOUNT, PRICE] to a Trade
+func parseTrade(trade []float64) Trade {
+	if len(trade) < 4 {
+		return Trade{}
+	}
+
+	t := Trade{
+		TID:       int(trade[0]),
+		Timestamp: int(trade[1] / 1000),
+		Price:     trade[3],
+		Amount:    trade[2],
+		Exchange:  "bitfinex",
+		Type:      "buy",
+	}
+	if t.Amount < 0 {
+		t.Amount = -t.Amount
+		t.Type = "sell"
+	}
+
+	return t
+}
@@ -0,0 +1,225 @@
+package bitfinex
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsServer starts a websocket server running script for each connection,
+// after answering the conf and subscribe messages
+func wsServer(t *testing.T, script func(conn *websocket.Conn, n int)) (*httptest.Server, func() int) {
+	var (
+		mu          sync.Mutex
+		connections int
+		upgrader    websocket.Upgrader
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		connections++
+		n := connections
+		mu.Unlock()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"info","version":2}`))
+		chanID := 0
+		for {
+			var e struct {
+				Event   string `json:"event"`
+				Channel string `json:"channel"`
+				Symbol  string `json:"symbol"`
+				Flags   int    `json:"flags"`
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if err := conn.ReadJSON(&e); err != nil {
+				break
+			}
+			switch e.Event {
+			case "conf":
+				if e.Flags&flagSeqAll == 0 || e.Flags&flagTimestamp == 0 {
+					t.Error("Expected sequence and timestamp flags")
+				}
+				conn.WriteJSON(map[string]interface{}{"event": "conf", "status": "OK", "flags": e.Flags})
+			case "subscribe":
+				chanID++
+				conn.WriteJSON(map[string]interface{}{"event": "subscribed", "channel": e.Channel, "chanId": chanID, "symbol": e.Symbol})
+			}
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		script(conn, n)
+	}))
+	server.URL = "ws" + strings.TrimPrefix(server.URL, "http")
+
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return connections
+	}
+}
+
+func send(conn *websocket.Conn, messages ...string) {
+	for _, message := range messages {
+		conn.WriteMessage(websocket.TextMessage, []byte(message))
+	}
+}
+
+func TestStream(t *testing.T) {
+	server, _ := wsServer(t, func(conn *websocket.Conn, n int) {
+		send(conn,
+			`[1,[[3,1444266681000,0.5,250.1],[2,1444266680000,-1,250]],1]`,
+			`[1,"hb",2]`,
+			`[1,"te",[4,1444266682000,-0.2,250.3],3]`,
+			`[1,"tu",[4,1444266682000,-0.2,250.3],4]`,
+			`[2,[250.2,3.5,250.4,2.1,1.5,0.006,250.3,12000,255,245],5,1444266683500]`,
+			`[3,[[250.2,2,3.5],[250.4,1,-2.1]],6]`,
+			`[3,[250.2,0,1],7]`,
+			`[3,"cs",-1234567,8]`,
+		)
+		time.Sleep(time.Second)
+	})
+	defer server.Close()
+
+	stream := NewStream(server.URL)
+	stream.SubscribeTrades("btcusd")
+	stream.SubscribeTicker("btcusd")
+	stream.SubscribeBook("btcusd", 25)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.Run(ctx)
+
+	// Test trades snapshot and update
+	trades := <-stream.Trades
+	if !trades.Snapshot || trades.Symbol != "btcusd" || len(trades.Trades) != 2 {
+		t.Fatalf("Unexpected trades snapshot %+v", trades)
+	}
+	if trades.Trades[0].TID != 3 || trades.Trades[0].Type != "buy" || trades.Trades[0].Timestamp != 1444266681 {
+		t.Fatalf("Unexpected trade %+v", trades.Trades[0])
+	}
+	if trades.Trades[1].Type != "sell" || trades.Trades[1].Amount != 1 {
+		t.Fatalf("Unexpected trade %+v", trades.Trades[1])
+	}
+	trades = <-stream.Trades
+	if trades.Snapshot || len(trades.Trades) != 1 || trades.Trades[0].TID != 4 || math.Abs(trades.Trades[0].Amount-0.2) > 0.000001 {
+		t.Fatalf("Unexpected trade update %+v", trades)
+	}
+
+	// Test ticker
+	ticker := <-stream.Tickers
+	if ticker.Bid != 250.2 || ticker.AskSize != 2.1 || ticker.LastPrice != 250.3 || ticker.Low != 245 || ticker.Timestamp != 1444266683.5 {
+		t.Fatalf("Unexpected ticker %+v", ticker)
+	}
+
+	// Test book snapshot and update
+	book := <-stream.Books
+	if !book.Snapshot || len(book.Levels) != 2 || book.Levels[1].Amount != -2.1 {
+		t.Fatalf("Unexpected book snapshot %+v", book)
+	}
+	book = <-stream.Books
+	if book.Snapshot || len(book.Levels) != 1 || book.Levels[0].Count != 0 {
+		t.Fatalf("Unexpected book update %+v", book)
+	}
+	book = <-stream.Books
+	if !book.IsChecksum || book.Checksum != -1234567 || len(book.Levels) != 0 {
+		t.Fatalf("Unexpected book checksum %+v", book)
+	}
+
+	// No further trades, "tu" repeats "te"
+	select {
+	case trades = <-stream.Trades:
+		t.Fatalf("Unexpected trades %+v", trades)
+	default:
+	}
+}
+
+func TestStreamReconnect(t *testing.T) {
+	server, connections := wsServer(t, func(conn *websocket.Conn, n int) {
+		switch n {
+		case 1:
+			// Skip a sequence number
+			send(conn, `[1,[[1,1444266680000,1,250]],1]`, `[1,"hb",3]`)
+			time.Sleep(time.Second)
+		case 2:
+			// Go quiet after the snapshot
+			send(conn, `[1,[[1,1444266680000,1,250]],1]`)
+			time.Sleep(time.Second)
+		default:
+			send(conn, `[1,[[2,1444266681000,1,251]],1]`)
+			time.Sleep(time.Second)
+		}
+	})
+	defer server.Close()
+
+	stream := NewStream(server.URL)
+	stream.HeartbeatTimeout = 200 * time.Millisecond
+	stream.ReconnectDelay = time.Millisecond
+	stream.SubscribeTrades("btcusd")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.Run(ctx)
+
+	<-stream.Trades
+	var gapErr *GapError
+	if err := <-stream.Errors; !errors.As(err, &gapErr) || gapErr.Expected != 2 || gapErr.Received != 3 {
+		t.Fatalf("Expected sequence gap, got %v", err)
+	}
+
+	// Resubscribed after the gap
+	if trades := <-stream.Trades; !trades.Snapshot {
+		t.Fatal("Expected snapshot after reconnect")
+	}
+	if err := <-stream.Errors; err != ErrHeartbeat {
+		t.Fatalf("Expected heartbeat timeout, got %v", err)
+	}
+
+	// Resubscribed after the heartbeat timeout
+	if trades := <-stream.Trades; trades.Trades[0].TID != 2 {
+		t.Fatal("Expected snapshot from third connection")
+	}
+	if connections() != 3 {
+		t.Fatalf("Expected three connections, got %d", connections())
+	}
+
+	// Test stopping
+	cancel()
+}
+
+func TestStreamResync(t *testing.T) {
+	server, connections := wsServer(t, func(conn *websocket.Conn, n int) {
+		send(conn, `[1,[[250,1,1]],1]`)
+		time.Sleep(time.Second)
+	})
+	defer server.Close()
+
+	stream := NewStream(server.URL)
+	stream.ReconnectDelay = time.Millisecond
+	stream.SubscribeBook("btcusd", 25)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.Run(ctx)
+
+	<-stream.Books
+	stream.Resync()
+	if err := <-stream.Errors; err != ErrResync {
+		t.Fatalf("Expected resync, got %v", err)
+	}
+	if book := <-stream.Books; !book.Snapshot {
+		t.Fatal("Expected snapshot after resync")
+	}
+	if connections() != 2 {
+		t.Fatalf("Expected two connections, got %d", connections())
+	}
+}
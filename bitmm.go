@@ -4,12 +4,25 @@ package main
 
 import (
 	"bitmm/bitfinex"
+	"bitmm/book"
+	"bitmm/exchange"
+	"bitmm/journal"
+	"bitmm/paper"
+	"bitmm/pnl"
+	"bitmm/quotes"
+	"bitmm/risk"
+	"bitmm/watchdog"
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
 	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"code.google.com/p/gcfg"
@@ -19,28 +32,77 @@ import (
 // Config stores user configuration
 type Config struct {
 	Sec struct {
-		Symbol         string  // Instrument to trade
-		TradeNum       int     // Number of trades to use in calculations
-		WeightDuration int     // Number of seconds back for a 50% weight
-		MinPos         float64 // Min order size
-		MaxPos         float64 // Maximum Position size
-		MinEdge        float64 // Minimum edge for position entry
-		StdMult        float64 // Multiplier for standard deviation
-		ExitPercent    float64 // Percent of edge for position exit
-		MinChange      float64 // Minumum change required to update prices
+		Symbol          string  // Instrument to trade
+		TradeNum        int     // Number of trades to use in calculations
+		WeightDuration  int     // Number of seconds back for a 50% weight
+		MinPos          float64 // Min order size
+		MaxPos          float64 // Maximum Position size
+		MinEdge         float64 // Minimum edge for position entry
+		StdMult         float64 // Multiplier for standard deviation
+		ExitPercent     float64 // Percent of edge for position exit
+		MinChange       float64 // Minumum change required to update prices
+		Timeout         int     // Seconds before an API call is abandoned
+		PublicLimit     int     // Max public API requests per minute, no limit if 0
+		AuthLimit       int     // Max authenticated API requests per minute, no limit if 0
+		Retries         int     // Max attempts for idempotent API calls
+		RetryDelay      float64 // Seconds before the first retry, doubled each retry
+		NonceFile       string  // File persisting the last API nonce across restarts
+		Websocket       bool    // Wait for streamed trades instead of polling
+		PaperBalance    float64 // Starting USD balance of the -paper account
+		RecordSymbols   string  // Comma separated symbols to record, Symbol if empty
+		RecordDir       string  // Directory for recorded market data
+		RecordRotate    int     // Minutes of market data in each recorded file
+		PnlFile         string  // File keeping inventory and daily P&L across restarts
+		MaxDailyLoss    float64 // Daily loss stopping trading, no limit if 0
+		MaxSessionLoss  float64 // Session loss stopping trading, no limit if 0
+		MaxDrawdown     float64 // Fall from peak session P&L stopping trading, no limit if 0
+		FlattenOnKill   bool    // Close the position with a market order when trading stops
+		KillFile        string  // File latching a tripped kill switch across restarts
+		MaxOrderSize    float64 // Largest order sent, no limit if 0
+		MaxNotional     float64 // Largest order value sent, no limit if 0
+		PriceCollar     float64 // Fraction an order price may be from theo and the last trade, no limit if 0
+		MaxOpenOrders   int     // Most orders live at once, no limit if 0
+		MaxOrderRate    int     // Most orders sent per minute, no limit if 0
+		Reconcile       int     // Seconds between reconciling orders with the exchange, never if 0
+		Orphans         string  // Orders live at startup: "cancel" them or "adopt" those for Symbol
+		FlattenOnExit   bool    // Close the position with a market order on quitting
+		WatchdogTimeout int     // Seconds without a completed loop before cancelling all orders, never if 0
+		HeartbeatFile   string  // File beating with the loop for the watchdog command, none if empty
 	}
 }
 
 var (
-	client     = bitfinex.New(os.Getenv("BITFINEX_KEY"), os.Getenv("BITFINEX_SECRET"))
+	client     exchange.Exchange
 	apiErrors  = false // Set to true on any error
-	liveOrders = false // Set to true on any order
 	orderTheo  = 0.0   // Theo value on which the live orders are based
 	orderPos   = 0.0   // Position on which the live orders are based
 	cfg        Config
+	books      *book.Books    // Local orderbooks, nil without the websocket
+	account    *paper.Account // Simulated account, nil unless -paper
+	clock      journal.Clock  = journal.System{}
+	events     journal.Events // Journal of inputs received on channels, if any
+	ledger     *pnl.Ledger    // P&L from streamed fills
+	killSwitch *risk.KillSwitch
+	preTrade   *risk.PreTrade     // Checks on every order sent, none if nil
+	quoter     *quotes.Manager    // Our orders on the exchange
+	deadman    *watchdog.Watchdog // Cancels all orders if the loop stalls, none if nil
+	paused     = false            // Quoting stopped by the operator
+	widening   = 1.0              // Multiplier of the quoted edge set by the operator
+	lastReply  string             // Outcome of the last operator command
 )
 
+// Time between polls when waiting for streamed trades
+const streamPoll = 5 * time.Second
+
 func main() {
+	// Exit with a failure status, once files are closed, if orders may be left live
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	fmt.Println("\nInitializing...")
 
 	// Set file for logging
@@ -53,58 +115,306 @@ func main() {
 
 	// Get config info
 	configFile := flag.String("config", "bitmm.gcfg", "Configuration file")
+	paperMode := flag.Bool("paper", false, "Trade a simulated account on live market data")
+	journalFile := flag.String("journal", "", "File journaling every input of the main loop for replay")
 	flag.Parse()
 	err = gcfg.ReadFileInto(&cfg, *configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Check for input to break loop
-	inputChan := make(chan rune)
+	if cfg.Sec.Orphans != orphansCancel && cfg.Sec.Orphans != orphansAdopt {
+		log.Fatalf("orphans must be %q or %q, not %q", orphansCancel, orphansAdopt, cfg.Sec.Orphans)
+	}
+	if timeout := time.Duration(cfg.Sec.WatchdogTimeout) * time.Second; timeout > 0 && (timeout <= streamPoll || timeout <= apiTimeout()) {
+		log.Fatalf("watchdogTimeout must be longer than the %s poll and the %s an API call may take with its retries, not %d",
+			streamPoll, apiTimeout(), cfg.Sec.WatchdogTimeout)
+	}
+
+	// Backtest on recorded trades or record market data instead of trading
+	switch flag.Arg(0) {
+	case "backtest":
+		if err := runBacktest(flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "record":
+		if err := runRecord(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "replay":
+		if err := runReplay(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "watchdog":
+		if err := runWatchdog(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Refuse to trade while the kill switch is tripped, unless resetting it
+	killSwitch, err = risk.NewKillSwitch(lossLimits(), stateFile(cfg.Sec.KillFile, *paperMode))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flag.Arg(0) == "reset" {
+		if err := killSwitch.Reset(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Kill switch reset.")
+		return
+	}
+	if err := killSwitch.Tripped(); err != nil {
+		fmt.Printf("\n%s\nRun bitmm reset once the cause is understood.\n", err)
+		log.Fatal(err)
+	}
+
+	preTrade = risk.NewPreTrade(orderLimits())
+
+	// Set up exchange client, blocking when over the request limits
+	nonce := bitfinex.NewNonce()
+	if cfg.Sec.NonceFile != "" {
+		nonce, err = bitfinex.NewFileNonce(cfg.Sec.NonceFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	bfx := bitfinex.New(os.Getenv("BITFINEX_KEY"), os.Getenv("BITFINEX_SECRET"),
+		bitfinex.NonceSource(nonce),
+		bitfinex.PublicLimit(bitfinex.NewLimiter(cfg.Sec.PublicLimit, time.Minute, true)),
+		bitfinex.AuthLimit(bitfinex.NewLimiter(cfg.Sec.AuthLimit, time.Minute, true)),
+		bitfinex.Retry(bitfinex.RetryPolicy{
+			MaxAttempts: cfg.Sec.Retries,
+			BaseDelay:   time.Duration(cfg.Sec.RetryDelay * float64(time.Second)),
+			MaxDelay:    time.Duration(cfg.Sec.Timeout) * time.Second,
+			Jitter:      0.5,
+		}))
+	client = bfx
+	if *paperMode {
+		account = paper.New(bfx, cfg.Sec.PaperBalance)
+		client = account
+	}
+
+	// Cancel all orders if the loop stalls, through the client itself as the
+	// stalled loop may hold the quote manager. Only the real account beats for
+	// the watchdog command.
+	if cfg.Sec.WatchdogTimeout > 0 {
+		heartbeat, raw := cfg.Sec.HeartbeatFile, client
+		if *paperMode {
+			heartbeat = ""
+		}
+		deadman = watchdog.New(time.Duration(cfg.Sec.WatchdogTimeout)*time.Second, heartbeat, func() bool {
+			return cancelStalled(raw, "main loop stalled")
+		})
+		go deadman.Run(context.Background())
+	}
+
+	// Account for fills, a separate ledger when paper trading
+	ledger, err = pnl.Load(stateFile(cfg.Sec.PnlFile, *paperMode))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Journal the settings and every input of the main loop for replay
+	if *journalFile != "" {
+		f, err := os.OpenFile(*journalFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w := journal.NewWriter(f)
+		w.Record("Config", nil, cfg.Sec, nil)
+		w.Record("Ledger", nil, ledger.State(), nil)
+		w.Record("Paper", nil, *paperMode, nil)
+		client = journal.NewClient(client, w)
+		clock = journal.NewClock(clock, w)
+		events = w
+	}
+	quoter = quotes.NewManager(client, cfg.Sec.MinChange)
+
+	// Stream trades and our fills so the loop runs when the market trades or
+	// we are filled instead of polling
+	var (
+		tradeChan <-chan bitfinex.TradeEvent
+		fillChan  <-chan bitfinex.Fill
+	)
+	if cfg.Sec.Websocket {
+		var streams exchange.Streaming = exchange.Websocket{Client: bfx}
+		market := streams.StreamMarket(context.Background(), cfg.Sec.Symbol, 25)
+		books = book.NewBooks(market.Resync)
+		go books.Run(context.Background(), market.Books, func(err error) { log.Printf("Book Error: %s\n", err) })
+		go logErrors(market.Errors, "Websocket")
+		tradeChan = market.Trades
+
+		if account == nil {
+			fills := streams.StreamFills(context.Background())
+			go logErrors(fills.Errors, "Session")
+			fillChan = fills.Fills
+		}
+	}
+
+	// Paper fills are taken as the account makes them, with or without the
+	// websocket
+	if account != nil {
+		fillChan = account.Fills
+	}
+
+	// Check for operator commands or a signal to break loop
+	inputChan := make(chan string)
 	go checkStdin(inputChan)
+	notifySignals(inputChan, make(chan os.Signal, 1))
+
+	// Run loop until quit is entered or a signal is received
+	if !runMainLoop(inputChan, tradeChan, fillChan) {
+		// Leave the heartbeat to go stale so the watchdog command cancels too
+		exitCode = 1
+	} else if deadman != nil {
+		if err := deadman.Stop(); err != nil {
+			log.Printf("Watchdog Error: %s\n", err)
+		}
+	}
+}
 
-	// Run loop until user input is received
-	runMainLoop(inputChan)
+// Trade on c from a fresh start: no orders or position known, no API errors,
+// quoting at the configured edge
+func resetLoop(c exchange.Exchange) {
+	client = c
+	orderTheo, orderPos, apiErrors, paused, widening = 0, 0, false, false, 1
+	quoter = quotes.NewManager(client, cfg.Sec.MinChange)
+}
+
+// Send each line entered, leaving stopping to signals without a terminal
+func checkStdin(inputChan chan<- string) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		inputChan <- scanner.Text()
+	}
 }
 
-// Check for any user input
-func checkStdin(inputChan chan<- rune) {
-	var ch rune
-	fmt.Scanf("%c", &ch)
-	inputChan <- ch
+// Send quit on the first SIGINT or SIGTERM relayed to signals, or sent on it,
+// so the loop stops as if entered by the user. A second signal kills the
+// process as usual.
+func notifySignals(inputChan chan<- string, signals chan os.Signal) {
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Received %s, shutting down\n", sig)
+		inputChan <- "quit"
+	}()
 }
 
-// Infinite loop
-func runMainLoop(inputChan <-chan rune) {
+// Infinite loop, run on each streamed trade or fill if tradeChan is not nil.
+// Returns whether orders were cancelled, and the position flattened if
+// configured, on stopping.
+func runMainLoop(inputChan <-chan string, tradeChan <-chan bitfinex.TradeEvent, fillChan <-chan bitfinex.Fill) bool {
 	positionChan := make(chan float64)
 
 	var (
-		trades    bitfinex.Trades
-		orders    bitfinex.Orders
-		start     time.Time
-		position  float64
-		theo      float64
-		stdev     float64
-		lastTrade int
+		trades      bitfinex.Trades
+		start       time.Time
+		position    float64
+		theo        float64
+		stdev       float64
+		lastTrade   int
+		filled      bool
+		reconciled  time.Time
+		recovered   bool
+		recoveries  int    // Failed attempts to recover
+		recoveryErr string // Last recovery error logged
 	)
 
 	for {
+		// Wait for streamed trades, polling anyway in case the stream is down
+		if tradeChan != nil {
+			select {
+			case line := <-inputChan:
+				journalEvent("Input", line)
+				if runCommand(line, theo, position) {
+					return exit(theo)
+				}
+			case <-tradeChan:
+				for len(tradeChan) > 0 {
+					<-tradeChan
+				}
+				journalEvent("Trade", nil)
+			case fill := <-fillChan:
+				journalEvent("Fill", fill)
+				takeFill(fill)
+				filled = true
+			case <-clock.After(streamPoll):
+				journalEvent("Poll", nil)
+			}
+		}
+
 		// Record time for each iteration
-		start = time.Now()
+		start = clock.Now()
 
-		// Cancel orders and exit if anything entered by user
+		// Run any command entered, cancelling orders and exiting on quit
 		select {
-		case <-inputChan:
-			exit()
-			return
+		case line := <-inputChan:
+			journalEvent("Input", line)
+			if runCommand(line, theo, position) {
+				return exit(theo)
+			}
 		default: // Continue if nothing on chan
 		}
 
+		// Quote only once orders and position left by an earlier session are
+		// accounted for, retrying with backoff until they are and logging each
+		// new error once
+		if !recovered {
+			err := recoverSession()
+			if err == nil {
+				recovered = true
+			} else {
+				if err.Error() != recoveryErr {
+					log.Printf("Recovery Error: %s\n", err)
+					recoveryErr = err.Error()
+				}
+				delay := recoveryDelay(recoveries)
+				recoveries++
+				fmt.Printf("\nRecovering: %s, retrying in %v\n", err, delay)
+
+				// Beat while waiting so the watchdog doesn't take the backoff for a stall
+				for wait := delay; wait > 0; wait -= streamPoll {
+					heartbeat()
+					step := wait
+					if step > streamPoll {
+						step = streamPoll
+					}
+					select {
+					case line := <-inputChan:
+						journalEvent("Input", line)
+						if runCommand(line, theo, position) {
+							return exit(theo)
+						}
+					case <-clock.After(step):
+						journalEvent("Poll", nil)
+					}
+				}
+				continue
+			}
+		}
+
 		// Check trades
 		trades = getTrades()
 
-		// If new trades check position and do calculations
-		if !apiErrors && trades[0].TID != lastTrade {
+		// Without the websocket, take the fills a paper account made on them
+		if tradeChan == nil {
+			for len(fillChan) > 0 {
+				fill := <-fillChan
+				journalEvent("Fill", fill)
+				takeFill(fill)
+				filled = true
+			}
+		}
+
+		// If new trades or fills check position and do calculations
+		if !apiErrors && (trades[0].TID != lastTrade || filled) {
 			go checkPosition(positionChan)
 
 			// Do calcs on trade data while waiting for position data
@@ -114,74 +424,185 @@ func runMainLoop(inputChan <-chan rune) {
 
 			// Reset for next iteration
 			lastTrade = trades[0].TID
+			filled = false
+		}
+
+		// Stop trading for good once a loss limit is breached
+		if !apiErrors && theo > 0 {
+			if err := checkLosses(theo, start); err != nil {
+				return kill(err, theo)
+			}
+		}
+
+		// Reconcile orders with the exchange now and then in case fills were missed
+		interval := time.Duration(cfg.Sec.Reconcile) * time.Second
+		if !apiErrors && interval > 0 && start.Sub(reconciled) >= interval {
+			reconcileOrders(start, fillChan != nil)
+			reconciled = start
 		}
 
-		// Send orders if necessary
-		if !apiErrors && (math.Abs(theo-orderTheo) >= cfg.Sec.MinChange ||
-			math.Abs(position-orderPos) >= cfg.Sec.MinPos || !liveOrders) {
-			orders = sendOrders(theo, position, stdev)
+		// Update orders if necessary, unless paused, keeping live quotes while the
+		// budget is too low to replace them
+		_, budget := exchange.Budget(client)
+		if !apiErrors && !paused && needOrders(theo, position) && (budget >= 2 || !quoter.Live()) {
+			sendOrders(theo, position, stdev, trades[0].Price, start)
 		}
 
 		// Print results
 		if !apiErrors {
-			printResults(orders, position, stdev, theo, start)
+			printResults(position, stdev, theo, start)
 		}
 
 		// Reset for next iteration
 		apiErrors = false
+		heartbeat()
 	}
 }
 
-// Send orders to the exchange
-func sendOrders(theo, position, stdev float64) bitfinex.Orders {
-	if liveOrders {
-		cancelAll()
+// Delay before retrying recovery after failed attempts, doubling from the
+// retry delay up to a minute
+func recoveryDelay(attempts int) time.Duration {
+	delay := time.Duration(cfg.Sec.RetryDelay * float64(time.Second))
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 0; i < attempts && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > time.Minute {
+		delay = time.Minute
+	}
+
+	return delay
+}
+
+// Account for one of our fills
+func takeFill(fill bitfinex.Fill) {
+	log.Printf("Filled %.4f %s @ %.4f\n", fill.Amount, fill.Symbol, fill.Price)
+	quoter.Fill(fill)
+	if ledger != nil {
+		if err := ledger.Add(fill); err != nil {
+			log.Printf("P&L Error: %s\n", err)
+		}
 	}
-	liveOrders = true
+}
+
+// Tell the watchdog, if any, that an iteration of the loop completed
+func heartbeat() {
+	if deadman == nil {
+		return
+	}
+	if err := deadman.Beat(); err != nil {
+		log.Printf("Heartbeat Error: %s\n", err)
+	}
+}
+
+// Check whether theo or position moved enough to requote, or no orders are live
+func needOrders(theo, position float64) bool {
+	return math.Abs(theo-orderTheo) >= cfg.Sec.MinChange ||
+		math.Abs(position-orderPos) >= cfg.Sec.MinPos || !quoter.Live()
+}
+
+// Update orders on the exchange to the strategy's quotes, sending only the
+// changed quotes that are within the pre-trade limits
+func sendOrders(theo, position, stdev, last float64, now time.Time) {
 	orderTheo = theo
 	orderPos = position
 
-	// Send new order request to the exchange
-	params := calculateOrderParams(position, theo, stdev)
-	orders, err := client.MultipleNewOrders(params)
-	checkErr(err, "MultipleNewOrders")
+	// Leave orders already quoted alone and check the rest against the limits
+	live, changed := quoter.Split(calculateOrderParams(position, theo, stdev))
+	if preTrade != nil {
+		exposure := risk.Exposure{Theo: theo, Last: last, Position: position, OpenOrders: len(live)}
+		for _, quote := range live {
+			if quote.Side == "buy" {
+				exposure.OpenBuys += quote.Amount
+			} else {
+				exposure.OpenSells += quote.Amount
+			}
+		}
+		var rejected []error
+		changed, rejected = preTrade.Check(changed, exposure, now)
+		for _, err := range rejected {
+			log.Println(err)
+		}
+	}
 
-	if orders.Message != "" || len(orders.Orders) == 0 || orders.Orders[0].ID == 0 {
-		cancelAll()
-		log.Printf("Order Problem %s\n", orders.Message)
+	ctx, cancel := apiContext()
+	defer cancel()
+	err := quoter.Update(ctx, append(live, changed...))
+	var rejected *quotes.RejectedError
+	if errors.As(err, &rejected) {
+		// Only a new order was refused, the orders live are still as the manager knows
+		log.Printf("UpdateOrders Error: %s\n", err)
+		return
 	}
+	checkErr(err, "UpdateOrders")
+}
 
-	return orders
+// Reconcile orders with the exchange, logging fills found and orders that
+// can't be accounted for. Fills found are accounted, and if fills are streamed
+// the ledger leaves out the same amounts when they are streamed later.
+func reconcileOrders(now time.Time, streamed bool) {
+	ctx, cancel := apiContext()
+	defer cancel()
+	report, err := quoter.Reconcile(ctx)
+	checkErr(err, "Reconcile")
+
+	for _, e := range report.Executions {
+		log.Printf("Reconciled fill of order %d: %s %.4f %s @ %.4f\n", e.OrderID, e.Side, e.Amount, e.Symbol, e.Price)
+		if ledger == nil {
+			continue
+		}
+		amount := e.Amount
+		if e.Side == "sell" {
+			amount = -amount
+		}
+		fill := bitfinex.Fill{OrderID: e.OrderID, Symbol: e.Symbol, Timestamp: float64(now.Unix()), Amount: amount, Price: e.Price}
+		add := ledger.Add
+		if streamed {
+			add = ledger.Reconciled
+		}
+		if err := add(fill); err != nil {
+			log.Printf("P&L Error: %s\n", err)
+		}
+	}
+	for _, o := range report.Unknown {
+		log.Printf("Unknown order %d on the exchange: %s %.4f %s @ %.4f\n", o.ID, o.Side, o.RemainingAmount, o.Symbol, o.Price)
+	}
+	for _, o := range report.Unaccounted {
+		log.Printf("Order %d unaccounted for by the exchange: %s %.4f %s @ %.4f\n", o.ID, o.Params.Side, o.Remaining, o.Params.Symbol, o.Params.Price)
+	}
 }
 
 // Calculate parameters for orders
 func calculateOrderParams(position, theo, stdev float64) []bitfinex.OrderParams {
 	var params []bitfinex.OrderParams
+	edge := math.Max(stdev, cfg.Sec.MinEdge) * widening
 
 	if math.Abs(position) < cfg.Sec.MinPos { // No position
 		params = []bitfinex.OrderParams{
-			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo - math.Max(stdev, cfg.Sec.MinEdge), "bitfinex", "buy", "limit"},
-			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo + math.Max(stdev, cfg.Sec.MinEdge), "bitfinex", "sell", "limit"},
+			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo - edge, "bitfinex", "buy", "limit"},
+			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo + edge, "bitfinex", "sell", "limit"},
 		}
 	} else if position < (-1*cfg.Sec.MaxPos)+cfg.Sec.MinPos { // Max short postion
 		params = []bitfinex.OrderParams{
-			{cfg.Sec.Symbol, -1 * position, theo - math.Max(stdev, cfg.Sec.MinEdge)*cfg.Sec.ExitPercent, "bitfinex", "buy", "limit"},
+			{cfg.Sec.Symbol, -1 * position, theo - edge*cfg.Sec.ExitPercent, "bitfinex", "buy", "limit"},
 		}
 	} else if position > cfg.Sec.MaxPos-cfg.Sec.MinPos { // Max long postion
 		params = []bitfinex.OrderParams{
-			{cfg.Sec.Symbol, position, theo + math.Max(stdev, cfg.Sec.MinEdge)*cfg.Sec.ExitPercent, "bitfinex", "sell", "limit"},
+			{cfg.Sec.Symbol, position, theo + edge*cfg.Sec.ExitPercent, "bitfinex", "sell", "limit"},
 		}
 	} else if (-1*cfg.Sec.MaxPos)+cfg.Sec.MinPos <= position && position <= -1*cfg.Sec.MinPos { // Partial short
 		params = []bitfinex.OrderParams{
-			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo - math.Max(stdev, cfg.Sec.MinEdge), "bitfinex", "buy", "limit"},
-			{cfg.Sec.Symbol, -1 * position, theo - math.Max(stdev, cfg.Sec.MinEdge)*cfg.Sec.ExitPercent, "bitfinex", "buy", "limit"},
-			{cfg.Sec.Symbol, cfg.Sec.MaxPos + position, theo + math.Max(stdev, cfg.Sec.MinEdge), "bitfinex", "sell", "limit"},
+			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo - edge, "bitfinex", "buy", "limit"},
+			{cfg.Sec.Symbol, -1 * position, theo - edge*cfg.Sec.ExitPercent, "bitfinex", "buy", "limit"},
+			{cfg.Sec.Symbol, cfg.Sec.MaxPos + position, theo + edge, "bitfinex", "sell", "limit"},
 		}
 	} else if cfg.Sec.MinPos <= position && position <= cfg.Sec.MaxPos-cfg.Sec.MinPos { // Partial long
 		params = []bitfinex.OrderParams{
-			{cfg.Sec.Symbol, cfg.Sec.MaxPos - position, theo - math.Max(stdev, cfg.Sec.MinEdge), "bitfinex", "buy", "limit"},
-			{cfg.Sec.Symbol, position, theo + math.Max(stdev, cfg.Sec.MinEdge)*cfg.Sec.ExitPercent, "bitfinex", "sell", "limit"},
-			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo + math.Max(stdev, cfg.Sec.MinEdge), "bitfinex", "sell", "limit"},
+			{cfg.Sec.Symbol, cfg.Sec.MaxPos - position, theo - edge, "bitfinex", "buy", "limit"},
+			{cfg.Sec.Symbol, position, theo + edge*cfg.Sec.ExitPercent, "bitfinex", "sell", "limit"},
+			{cfg.Sec.Symbol, cfg.Sec.MaxPos, theo + edge, "bitfinex", "sell", "limit"},
 		}
 	}
 
@@ -191,7 +612,9 @@ func calculateOrderParams(position, theo, stdev float64) []bitfinex.OrderParams
 // Get position data
 func checkPosition(positionChan chan<- float64) {
 	var position float64
-	posSlice, err := client.ActivePositions()
+	ctx, cancel := apiContext()
+	defer cancel()
+	posSlice, err := client.ActivePositionsContext(ctx)
 	checkErr(err, "ActivePositions")
 	for _, pos := range posSlice {
 		if pos.Symbol == cfg.Sec.Symbol {
@@ -204,7 +627,9 @@ func checkPosition(positionChan chan<- float64) {
 
 // Get trade data
 func getTrades() bitfinex.Trades {
-	trades, err := client.Trades(cfg.Sec.Symbol, cfg.Sec.TradeNum)
+	ctx, cancel := apiContext()
+	defer cancel()
+	trades, err := client.TradesContext(ctx, cfg.Sec.Symbol, cfg.Sec.TradeNum)
 	checkErr(err, "Trades")
 
 	return trades
@@ -234,6 +659,20 @@ func calculateStdev(trades bitfinex.Trades) float64 {
 	return cfg.Sec.StdMult * stat.Sd(x)
 }
 
+// Journal an input received on a channel, when journaling or replaying
+func journalEvent(kind string, data interface{}) {
+	if events != nil {
+		events.Event(kind, data)
+	}
+}
+
+// Log errors from a background task
+func logErrors(errChan <-chan error, name string) {
+	for err := range errChan {
+		log.Printf("%s Error: %s\n", name, err)
+	}
+}
+
 // Called on any error
 func checkErr(err error, methodName string) {
 	if err != nil {
@@ -243,36 +682,222 @@ func checkErr(err error, methodName string) {
 	}
 }
 
-// Call on exit
-func exit() {
-	cancelAll()
-	fmt.Println("\nCancelled all orders.")
+// Call on exit, cancelling orders and optionally flattening the position, and
+// report whether it succeeded
+func exit(theo float64) bool {
+	ok := cancelConfirmed()
+	if ok {
+		fmt.Println("\nCancelled all orders.")
+	} else {
+		fmt.Println("\nFAILED TO CANCEL ORDERS, check the exchange.")
+	}
+	if ok && cfg.Sec.FlattenOnExit {
+		ok = flatten(theo)
+	}
+	if account != nil {
+		realized, unrealized := account.PL()
+		fmt.Printf("Paper P&L: %.4f realized, %.4f unrealized\n", realized, unrealized)
+	}
+
+	return ok
+}
+
+// Check session and daily P&L, marking the inventory to theo, against the
+// loss limits
+func checkLosses(theo float64, now time.Time) error {
+	if killSwitch == nil || ledger == nil {
+		return nil
+	}
+	open := ledger.Inventory(cfg.Sec.Symbol).Unrealized(theo)
+	session, daily := ledger.Session(), ledger.Day(now)
+
+	return killSwitch.Check(session.Realized-session.Fees+open, daily.Realized-daily.Fees+open, now)
+}
+
+// Call when a loss limit is breached, cancelling orders and optionally
+// flattening the position, and report whether it succeeded
+func kill(err error, theo float64) bool {
+	log.Println(err)
+	fmt.Printf("\nKILL SWITCH TRIPPED: %s\n", err)
+	ok := cancelConfirmed()
+	if !ok {
+		fmt.Println("FAILED TO CANCEL ORDERS, check the exchange.")
+	}
+	if ok && cfg.Sec.FlattenOnKill {
+		ok = flatten(theo)
+	}
+	fmt.Println("Run bitmm reset once the cause is understood.")
+
+	return ok
+}
+
+// Close the position with a market order, and report whether it was sent
+func flatten(theo float64) bool {
+	positionChan := make(chan float64, 1)
+	apiErrors = false
+	checkPosition(positionChan)
+	position := <-positionChan
+	if apiErrors {
+		fmt.Println("FAILED TO FLATTEN POSITION, check the exchange.")
+		return false
+	}
+	if math.Abs(position) < cfg.Sec.MinPos {
+		return true
+	}
+
+	side := "sell"
+	if position < 0 {
+		side = "buy"
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+	_, err := client.NewOrderContext(ctx, cfg.Sec.Symbol, math.Abs(position), theo, "bitfinex", side, "market")
+	if err != nil {
+		log.Printf("Flatten Error: %s\n", err)
+		fmt.Println("FAILED TO FLATTEN POSITION, check the exchange.")
+		return false
+	}
+	fmt.Printf("Sent market %s of %.4f to flatten the position.\n", side, math.Abs(position))
+
+	return true
+}
+
+// Loss limits from the config
+func lossLimits() risk.LossLimits {
+	return risk.LossLimits{
+		Daily:    cfg.Sec.MaxDailyLoss,
+		Session:  cfg.Sec.MaxSessionLoss,
+		Drawdown: cfg.Sec.MaxDrawdown,
+	}
+}
+
+// Pre-trade order limits from the config
+func orderLimits() risk.OrderLimits {
+	return risk.OrderLimits{
+		MaxSize:       cfg.Sec.MaxOrderSize,
+		MaxNotional:   cfg.Sec.MaxNotional,
+		Collar:        cfg.Sec.PriceCollar,
+		MaxOpenOrders: cfg.Sec.MaxOpenOrders,
+		MaxPosition:   cfg.Sec.MaxPos,
+		MaxRate:       cfg.Sec.MaxOrderRate,
+	}
+}
+
+// File keeping state across restarts, a separate one when paper trading
+func stateFile(path string, paper bool) string {
+	if paper && path != "" {
+		return path + ".paper"
+	}
+
+	return path
+}
+
+// Cancel all orders and confirm the exchange shows none live
+func cancelConfirmed() bool {
+	if !cancelAll() {
+		return false
+	}
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	orders, err := client.ActiveOrdersContext(ctx)
+	if err != nil || len(orders) > 0 {
+		log.Printf("CancelAll Error: %d orders still live: %v\n", len(orders), err)
+		return false
+	}
+
+	return true
+}
+
+// Cancel all orders, retrying with backoff, and report whether it was confirmed
+func cancelAll() bool {
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	if err := quoter.CancelAll(ctx); err != nil {
+		log.Printf("CancelAll Error: %s\n", err)
+		return false
+	}
+
+	return true
+}
+
+// Context with the configured deadline for an API call
+func apiContext() (context.Context, context.CancelFunc) {
+	if cfg.Sec.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), apiTimeout())
 }
 
-// Cancel all orders
-func cancelAll() {
-	cancelled := false
-	for !cancelled {
-		cancelled, _ = client.CancelAll()
+// Deadline of an API call, allowing time for each retry as well as the first
+// attempt, 0 if unlimited
+func apiTimeout() time.Duration {
+	if cfg.Sec.Timeout <= 0 {
+		return 0
 	}
-	liveOrders = false
+	attempts := math.Max(1, float64(cfg.Sec.Retries))
+
+	return time.Duration(attempts*float64(cfg.Sec.Timeout)) * time.Second
 }
 
 // Print results
-func printResults(orders bitfinex.Orders, position, stdev, theo float64, start time.Time) {
+func printResults(position, stdev, theo float64, start time.Time) {
 
 	clearScreen()
 
 	fmt.Printf("\nPosition: %.2f\n", position)
 	fmt.Printf("Stdev:    %.4f\n", stdev)
 	fmt.Printf("Theo:     %.4f\n", theo)
+	var (
+		mid     float64
+		haveMid bool
+	)
+	if books != nil {
+		if b := books.Get(cfg.Sec.Symbol); b != nil && b.Synced() {
+			bid, bidSize, _ := b.BestBid()
+			ask, askSize, _ := b.BestAsk()
+			fmt.Printf("Market:   %.2f @ %.4f / %.4f @ %.2f\n", bidSize, bid, ask, askSize)
+			mid, haveMid = b.Mid()
+		}
+	}
+
+	if ledger != nil {
+		inventory := ledger.Inventory(cfg.Sec.Symbol)
+		fmt.Printf("\nEntry:    %.2f @ %.4f\n", inventory.Amount, inventory.Price)
+		fmt.Printf("Open P&L: %.4f at theo", inventory.Unrealized(theo))
+		if haveMid {
+			fmt.Printf(", %.4f at mid", inventory.Unrealized(mid))
+		}
+		fmt.Println()
+		for _, period := range []struct {
+			name   string
+			totals pnl.Totals
+		}{{"Session", ledger.Session()}, {"Today", ledger.Day(start)}} {
+			t := period.totals
+			fmt.Printf("%-9s %.4f realized, %.4f fees, %.4f net, %.2f turnover, %d fills\n",
+				period.name+":", t.Realized, t.Fees, t.Realized-t.Fees, t.Turnover, t.Fills)
+		}
+	}
+
+	if paused {
+		fmt.Println("\nQuoting paused, enter resume to quote again")
+	}
+	if lastReply != "" {
+		fmt.Printf("\n%s\n", lastReply)
+	}
 
 	fmt.Println("\nActive orders:")
-	for _, order := range orders.Orders {
-		fmt.Printf("%7.2f %s @ %6.4f\n", order.Amount, cfg.Sec.Symbol, order.Price)
+	for _, order := range quoter.Orders() {
+		amount := order.Remaining
+		if order.Params.Side == "sell" {
+			amount = -amount
+		}
+		fmt.Printf("%7.2f %s @ %6.4f %s\n", amount, cfg.Sec.Symbol, order.Params.Price, order.State)
 	}
 
-	fmt.Printf("\n%v processing time...", time.Since(start))
+	fmt.Printf("\n%v processing time...", clock.Now().Sub(start))
 }
 
 // Clear the terminal between prints
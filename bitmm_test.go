@@ -2,7 +2,16 @@ package main
 
 import (
 	"bitmm/bitfinex"
+	"bitmm/exchange"
+	"bitmm/journal"
+	"bitmm/paper"
+	"bitmm/pnl"
+	"bitmm/risk"
 	"code.google.com/p/gcfg"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	// "github.com/davecgh/go-spew/spew"
 	"testing"
 )
@@ -58,3 +67,107 @@ func TestCalcOrderParams(t *testing.T) {
 		t.Fatal("Should create two orders")
 	}
 }
+
+// Set up the loop to trade on c from a fresh start, on the system clock with
+// nothing journaled, no streamed orderbooks and no paper account
+func setupLoop(c exchange.Exchange) {
+	clock, events, books, account = journal.System{}, nil, nil, nil
+	resetLoop(c)
+}
+
+func TestKill(t *testing.T) {
+	err := gcfg.ReadFileInto(&cfg, "bitmm.gcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sec.MaxSessionLoss = 10
+	cfg.Sec.FlattenOnKill = true
+
+	// Long 2 bought at 260 with the market at 250
+	market := &replay{}
+	for i := 0; i < 60; i++ {
+		market.trades = append(market.trades, bitfinex.Trade{Timestamp: 60 * i, TID: i + 1, Price: 250, Amount: 1})
+	}
+	market.n = len(market.trades)
+	a := paper.New(market, 1000)
+	a.Match(cfg.Sec.Symbol, market.trades)
+	if _, err := a.NewOrderContext(context.Background(), cfg.Sec.Symbol, 2, 0, "bitfinex", "buy", "market"); err != nil {
+		t.Fatal(err)
+	}
+	ledger = pnl.Restore("", pnl.State{Inventory: map[string]*pnl.Inventory{cfg.Sec.Symbol: {Amount: 2, Price: 260}}})
+
+	path := filepath.Join(t.TempDir(), "bitmm.kill")
+	killSwitch, err = risk.NewKillSwitch(lossLimits(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupLoop(a)
+
+	// The loop returns without input once the limit is breached
+	runMainLoop(make(chan string), nil, nil)
+
+	if err := killSwitch.Tripped(); !errors.Is(err, risk.ErrTripped) {
+		t.Fatalf("Expected kill switch tripped, got %v", err)
+	}
+	if positions, _ := a.ActivePositionsContext(context.Background()); len(positions) != 0 {
+		t.Fatalf("Expected position flattened, got %+v", positions)
+	}
+	if orders, _ := a.ActiveOrdersContext(context.Background()); len(orders) != 0 {
+		t.Fatalf("Expected orders cancelled, got %+v", orders)
+	}
+
+	// Restarting stays tripped until reset
+	restarted, err := risk.NewKillSwitch(lossLimits(), path)
+	if err != nil || restarted.Tripped() == nil {
+		t.Fatalf("Expected latch to survive restart, got %v", err)
+	}
+}
+
+// stuck is an account whose orders can't be cancelled
+type stuck struct {
+	*paper.Account
+}
+
+func (stuck) CancelAllContext(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+func TestShutdown(t *testing.T) {
+	err := gcfg.ReadFileInto(&cfg, "bitmm.gcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sec.FlattenOnExit = true
+
+	market := &replay{}
+	for i := 0; i < 60; i++ {
+		market.trades = append(market.trades, bitfinex.Trade{Timestamp: 60 * i, TID: i + 1, Price: 250, Amount: 1})
+	}
+	market.n = len(market.trades)
+	a := paper.New(market, 1000)
+	a.Match(cfg.Sec.Symbol, market.trades)
+	a.NewOrderContext(context.Background(), cfg.Sec.Symbol, 2, 0, "bitfinex", "buy", "market")
+	ledger, killSwitch = nil, nil
+	setupLoop(a)
+
+	// A signal stops the loop like input
+	inputChan, signals := make(chan string), make(chan os.Signal, 1)
+	notifySignals(inputChan, signals)
+	signals <- os.Interrupt
+	if !runMainLoop(inputChan, nil, nil) {
+		t.Fatal("Expected clean shutdown")
+	}
+	if positions, _ := a.ActivePositionsContext(context.Background()); len(positions) != 0 {
+		t.Fatalf("Expected position flattened, got %+v", positions)
+	}
+
+	// Orders that can't be cancelled fail the shutdown, without flattening
+	a.NewOrderContext(context.Background(), cfg.Sec.Symbol, 1, 0, "bitfinex", "buy", "market")
+	resetLoop(stuck{a})
+	if exit(250) {
+		t.Fatal("Expected failed shutdown")
+	}
+	if positions, _ := a.ActivePositionsContext(context.Background()); len(positions) != 1 {
+		t.Fatalf("Expected position left, got %+v", positions)
+	}
+}
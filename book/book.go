@@ -0,0 +1,318 @@
+// Local L2 orderbooks maintained from websocket snapshots and updates
+
+package book
+
+import (
+	"bitmm/bitfinex"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Levels included in the exchange checksum
+const checksumLevels = 25
+
+// Errors making a book inconsistent until the next snapshot
+var (
+	ErrNotSynced = errors.New("book: update before snapshot")
+	ErrCrossed   = errors.New("book: best bid at or above best ask")
+)
+
+// ChecksumError reports a book that no longer matches the exchange
+type ChecksumError struct {
+	Symbol   string
+	Expected int32 // Checksum sent by the exchange
+	Computed int32 // Checksum of the local book
+}
+
+// Book is a local L2 orderbook for one symbol, safe for concurrent use
+type Book struct {
+	Symbol string
+
+	mu     sync.RWMutex
+	bids   map[float64]float64 // Size by price
+	asks   map[float64]float64 // Size by price, positive
+	synced bool                // True between a snapshot and an inconsistency
+}
+
+// Books maintains a Book per symbol from a stream of book events
+type Books struct {
+	mu     sync.RWMutex
+	books  map[string]*Book
+	resync func() // Requests new snapshots, e.g. Stream.Resync
+}
+
+// New returns an empty book waiting for a snapshot
+func New(symbol string) *Book {
+	return &Book{
+		Symbol: symbol,
+		bids:   make(map[float64]float64),
+		asks:   make(map[float64]float64),
+	}
+}
+
+// NewBooks returns books calling resync whenever one becomes inconsistent
+func NewBooks(resync func()) *Books {
+	return &Books{books: make(map[string]*Book), resync: resync}
+}
+
+// Error describes the mismatch
+func (err *ChecksumError) Error() string {
+	return fmt.Sprintf("book: %s checksum %d does not match exchange %d", err.Symbol, err.Computed, err.Expected)
+}
+
+// Run applies events until the channel closes or ctx is done, calling
+// errFunc (if not nil) for each inconsistency
+func (books *Books) Run(ctx context.Context, events <-chan bitfinex.BookEvent, errFunc func(error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := books.Apply(e); err != nil && errFunc != nil {
+				errFunc(err)
+			}
+		}
+	}
+}
+
+// Apply updates the symbol's book, requesting a resync if it is inconsistent
+func (books *Books) Apply(e bitfinex.BookEvent) error {
+	book := books.Get(e.Symbol)
+	if book == nil {
+		books.mu.Lock()
+		if book = books.books[e.Symbol]; book == nil {
+			book = New(e.Symbol)
+			books.books[e.Symbol] = book
+		}
+		books.mu.Unlock()
+	}
+
+	// Only the first failure after a snapshot asks for a resync
+	wasSynced := book.Synced()
+	err := book.Apply(e)
+	if err != nil && wasSynced && books.resync != nil {
+		books.resync()
+	}
+
+	return err
+}
+
+// Get returns the symbol's book, nil if no events were seen for it
+func (books *Books) Get(symbol string) *Book {
+	books.mu.RLock()
+	defer books.mu.RUnlock()
+
+	return books.books[symbol]
+}
+
+// Apply updates the book with a snapshot, update or checksum. On error the book
+// is marked unsynced and ignores updates until the next snapshot.
+func (book *Book) Apply(e bitfinex.BookEvent) error {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	if e.Snapshot {
+		book.bids = make(map[float64]float64)
+		book.asks = make(map[float64]float64)
+		book.synced = true
+	} else if !book.synced {
+		return ErrNotSynced
+	}
+
+	if e.IsChecksum {
+		if computed := book.checksum(); computed != e.Checksum {
+			book.synced = false
+			return &ChecksumError{book.Symbol, e.Checksum, computed}
+		}
+		return nil
+	}
+
+	for _, level := range e.Levels {
+		side := book.bids
+		if level.Amount < 0 {
+			side = book.asks
+		}
+		if level.Count == 0 {
+			delete(side, level.Price)
+		} else if level.Amount < 0 {
+			side[level.Price] = -level.Amount
+		} else {
+			side[level.Price] = level.Amount
+		}
+	}
+
+	if bid, _, ok := book.best(true); ok {
+		if ask, _, ok := book.best(false); ok && bid >= ask {
+			book.synced = false
+			return ErrCrossed
+		}
+	}
+
+	return nil
+}
+
+// Synced reports whether the book is consistent with the exchange
+func (book *Book) Synced() bool {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	return book.synced
+}
+
+// BestBid returns the highest bid, ok is false if there are none
+func (book *Book) BestBid() (price, size float64, ok bool) {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	return book.best(true)
+}
+
+// BestAsk returns the lowest ask, ok is false if there are none
+func (book *Book) BestAsk() (price, size float64, ok bool) {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	return book.best(false)
+}
+
+// Mid returns the midpoint of the best bid and ask, ok is false if either is missing
+func (book *Book) Mid() (mid float64, ok bool) {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	bid, _, bidOK := book.best(true)
+	ask, _, askOK := book.best(false)
+
+	return (bid + ask) / 2, bidOK && askOK
+}
+
+// Depth returns the size resting at price on either side
+func (book *Book) Depth(price float64) float64 {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	return book.bids[price] + book.asks[price]
+}
+
+// CumulativeBids returns the total bid size at price or higher, i.e. the size
+// a sell down to price would trade against
+func (book *Book) CumulativeBids(price float64) float64 {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	var total float64
+	for p, size := range book.bids {
+		if p >= price {
+			total += size
+		}
+	}
+
+	return total
+}
+
+// CumulativeAsks returns the total ask size at price or lower, i.e. the size
+// a buy up to price would trade against
+func (book *Book) CumulativeAsks(price float64) float64 {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	var total float64
+	for p, size := range book.asks {
+		if p <= price {
+			total += size
+		}
+	}
+
+	return total
+}
+
+// Bids returns up to n bids, best first, all if n <= 0
+func (book *Book) Bids(n int) []bitfinex.BookItems {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	return levels(book.bids, n, true)
+}
+
+// Asks returns up to n asks, best first, all if n <= 0
+func (book *Book) Asks(n int) []bitfinex.BookItems {
+	book.mu.RLock()
+	defer book.mu.RUnlock()
+
+	return levels(book.asks, n, false)
+}
+
+// best returns the best level on one side
+func (book *Book) best(bids bool) (price, size float64, ok bool) {
+	side := book.asks
+	if bids {
+		side = book.bids
+	}
+
+	for p, s := range side {
+		if !ok || (bids && p > price) || (!bids && p < price) {
+			price, size, ok = p, s, true
+		}
+	}
+
+	return price, size, ok
+}
+
+// checksum computes the exchange checksum: CRC32 of the top bid and ask levels
+// interleaved as "bidPrice:bidAmount:askPrice:-askAmount:..."
+func (book *Book) checksum() int32 {
+	bids := levels(book.bids, checksumLevels, true)
+	asks := levels(book.asks, checksumLevels, false)
+
+	var fields []string
+	for i := 0; i < checksumLevels; i++ {
+		if i < len(bids) {
+			fields = append(fields, formatNumber(bids[i].Price), formatNumber(bids[i].Amount))
+		}
+		if i < len(asks) {
+			fields = append(fields, formatNumber(asks[i].Price), formatNumber(-asks[i].Amount))
+		}
+	}
+
+	return int32(crc32.ChecksumIEEE([]byte(strings.Join(fields, ":"))))
+}
+
+// levels returns up to n levels of a side sorted best first
+func levels(side map[float64]float64, n int, descending bool) []bitfinex.BookItems {
+	items := make([]bitfinex.BookItems, 0, len(side))
+	for price, size := range side {
+		items = append(items, bitfinex.BookItems{Price: price, Amount: size})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if descending {
+			return items[i].Price > items[j].Price
+		}
+		return items[i].Price < items[j].Price
+	})
+	if n > 0 && n < len(items) {
+		items = items[:n]
+	}
+
+	return items
+}
+
+// formatNumber formats a number the way the exchange does for checksums,
+// matching JavaScript number to string conversion
+func formatNumber(f float64) string {
+	if f != 0 && (f < 1e-6 && f > -1e-6) {
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		// JavaScript writes 1e-7 where Go writes 1e-07
+		return strings.Replace(strings.Replace(s, "e-0", "e-", 1), "e+0", "e+", 1)
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,115 @@
+package book
+
+import (
+	"bitmm/bitfinex"
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+func snapshot() bitfinex.BookEvent {
+	return bitfinex.BookEvent{Symbol: "btcusd", Snapshot: true, Levels: []bitfinex.BookLevel{
+		{Price: 250.1, Count: 2, Amount: 1.5},
+		{Price: 250, Count: 1, Amount: 2},
+		{Price: 249.5, Count: 3, Amount: 4},
+		{Price: 250.3, Count: 1, Amount: -0.5},
+		{Price: 250.4, Count: 2, Amount: -3},
+	}}
+}
+
+func TestBook(t *testing.T) {
+	book := New("btcusd")
+	if err := book.Apply(bitfinex.BookEvent{Symbol: "btcusd"}); err != ErrNotSynced {
+		t.Fatal("Expected not synced before snapshot")
+	}
+	if err := book.Apply(snapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Test queries
+	if price, size, ok := book.BestBid(); !ok || price != 250.1 || size != 1.5 {
+		t.Fatalf("Unexpected best bid %v %v", price, size)
+	}
+	if price, size, ok := book.BestAsk(); !ok || price != 250.3 || size != 0.5 {
+		t.Fatalf("Unexpected best ask %v %v", price, size)
+	}
+	if mid, ok := book.Mid(); !ok || mid != 250.2 {
+		t.Fatalf("Unexpected mid %v", mid)
+	}
+	if book.Depth(250) != 2 || book.Depth(250.4) != 3 || book.Depth(251) != 0 {
+		t.Fatal("Unexpected depth")
+	}
+	if book.CumulativeBids(250) != 3.5 || book.CumulativeAsks(250.4) != 3.5 {
+		t.Fatal("Unexpected cumulative size")
+	}
+
+	// Test updating and removing levels
+	err := book.Apply(bitfinex.BookEvent{Symbol: "btcusd", Levels: []bitfinex.BookLevel{
+		{Price: 250.1, Count: 0, Amount: 1},
+		{Price: 250.3, Count: 2, Amount: -1.25},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price, _, _ := book.BestBid(); price != 250 {
+		t.Fatal("Best bid not removed")
+	}
+	if _, size, _ := book.BestAsk(); size != 1.25 {
+		t.Fatal("Best ask not updated")
+	}
+	if bids := book.Bids(1); len(bids) != 1 || bids[0].Price != 250 {
+		t.Fatal("Unexpected bids")
+	}
+	if asks := book.Asks(0); len(asks) != 2 || asks[1].Price != 250.4 {
+		t.Fatal("Unexpected asks")
+	}
+
+	// Test crossed book
+	err = book.Apply(bitfinex.BookEvent{Symbol: "btcusd", Levels: []bitfinex.BookLevel{{Price: 250.5, Count: 1, Amount: 1}}})
+	if err != ErrCrossed || book.Synced() {
+		t.Fatal("Expected crossed book")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	book := New("btcusd")
+	book.Apply(snapshot())
+
+	expected := int32(crc32.ChecksumIEEE([]byte("250.1:1.5:250.3:-0.5:250:2:250.4:-3:249.5:4")))
+	if err := book.Apply(bitfinex.BookEvent{Symbol: "btcusd", IsChecksum: true, Checksum: expected}); err != nil {
+		t.Fatal(err)
+	}
+
+	var checksumErr *ChecksumError
+	err := book.Apply(bitfinex.BookEvent{Symbol: "btcusd", IsChecksum: true, Checksum: expected + 1})
+	if !errors.As(err, &checksumErr) || checksumErr.Computed != expected || book.Synced() {
+		t.Fatalf("Expected checksum error, got %v", err)
+	}
+
+	if formatNumber(0.0000001) != "1e-7" || formatNumber(-2.5) != "-2.5" || formatNumber(250) != "250" {
+		t.Fatal("Numbers not formatted like the exchange")
+	}
+}
+
+func TestBooks(t *testing.T) {
+	resyncs := 0
+	books := NewBooks(func() { resyncs++ })
+
+	if err := books.Apply(snapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if books.Get("btcusd") == nil || books.Get("ltcusd") != nil {
+		t.Fatal("Expected a book for btcusd only")
+	}
+
+	// Test a single resync until the next snapshot
+	books.Apply(bitfinex.BookEvent{Symbol: "btcusd", IsChecksum: true, Checksum: 1})
+	books.Apply(bitfinex.BookEvent{Symbol: "btcusd", Levels: []bitfinex.BookLevel{{Price: 250, Count: 1, Amount: 1}}})
+	if resyncs != 1 {
+		t.Fatalf("Expected one resync, got %d", resyncs)
+	}
+	books.Apply(snapshot())
+	if !books.Get("btcusd").Synced() {
+		t.Fatal("Expected book synced after snapshot")
+	}
+}
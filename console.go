@@ -0,0 +1,183 @@
+// Operator commands entered on stdin while trading
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Most the quoted edge may be widened
+const maxWidening = 10
+
+// Commands accepted, listed when one is rejected
+const commandHelp = "pause, resume, flatten, cancel, set <setting> <value>, widen <factor>x, status or quit"
+
+// Settings the set command changes while trading
+var settings = []struct {
+	name  string
+	value *float64
+}{
+	{"maxPos", &cfg.Sec.MaxPos},
+	{"minPos", &cfg.Sec.MinPos},
+	{"minEdge", &cfg.Sec.MinEdge},
+	{"stdMult", &cfg.Sec.StdMult},
+	{"exitPercent", &cfg.Sec.ExitPercent},
+	{"minChange", &cfg.Sec.MinChange},
+}
+
+// Run a command entered by the operator, logging it and the outcome for
+// audit, and report whether to quit
+func runCommand(line string, theo, position float64) (quit bool) {
+	reply, quit, err := command(line, theo, position)
+	if err != nil {
+		reply = "rejected: " + err.Error()
+	}
+	log.Printf("Audit: operator command %q: %s\n", line, reply)
+	lastReply = fmt.Sprintf("> %s: %s", strings.TrimSpace(line), reply)
+	fmt.Printf("\n%s\n", lastReply)
+
+	return quit
+}
+
+// Carry out a command, returning its outcome or why it was rejected
+func command(line string, theo, position float64) (reply string, quit bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false, errors.New("enter " + commandHelp)
+	}
+	name, args := strings.ToLower(fields[0]), fields[1:]
+	switch name {
+	case "set":
+		reply, err = set(args)
+		return reply, false, err
+	case "widen":
+		reply, err = widen(args)
+		return reply, false, err
+	case "pause", "resume", "flatten", "cancel", "status", "quit":
+		if len(args) > 0 {
+			return "", false, fmt.Errorf("%s takes no arguments", name)
+		}
+	default:
+		return "", false, fmt.Errorf("unknown command %q, enter %s", fields[0], commandHelp)
+	}
+
+	switch name {
+	case "pause":
+		paused = true
+		if !cancelConfirmed() {
+			return "quoting paused, FAILED TO CANCEL ORDERS, check the exchange", false, nil
+		}
+		return "quoting paused, all orders cancelled", false, nil
+	case "resume":
+		if !paused {
+			return "", false, errors.New("not paused")
+		}
+		paused = false
+		return "quoting resumed", false, nil
+	case "flatten":
+		if theo <= 0 {
+			return "", false, errors.New("no theo to flatten at yet")
+		}
+		// Quoting again would reopen the position
+		paused = true
+		if !cancelConfirmed() {
+			return "quoting paused, FAILED TO CANCEL ORDERS, position not flattened, check the exchange", false, nil
+		}
+		if !flatten(theo) {
+			return "quoting paused, orders cancelled, FAILED TO FLATTEN POSITION, check the exchange", false, nil
+		}
+		return "quoting paused, orders cancelled, position flattened", false, nil
+	case "cancel":
+		if !cancelConfirmed() {
+			return "FAILED TO CANCEL ORDERS, check the exchange", false, nil
+		}
+		return "all orders cancelled", false, nil
+	case "status":
+		return status(theo, position), false, nil
+	}
+
+	return "quitting", true, nil
+}
+
+// Change a setting, rejecting values the strategy can't quote with, and
+// requote on the new value
+func set(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errors.New("usage: set <setting> <value>")
+	}
+	var names []string
+	for _, setting := range settings {
+		names = append(names, setting.name)
+		if !strings.EqualFold(setting.name, args[0]) {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+			return "", fmt.Errorf("%s must be a number of at least 0, not %q", setting.name, args[1])
+		}
+		old := *setting.value
+		*setting.value = value
+		if err := checkSettings(); err != nil {
+			*setting.value = old
+			return "", err
+		}
+
+		// Apply to the checks and quotes depending on the setting
+		if preTrade != nil {
+			preTrade.Limits = orderLimits()
+		}
+		quoter.Tolerance = cfg.Sec.MinChange
+		orderTheo = 0
+
+		return fmt.Sprintf("%s changed from %g to %g", setting.name, old, value), nil
+	}
+
+	return "", fmt.Errorf("unknown setting %q, set one of %s", args[0], strings.Join(names, ", "))
+}
+
+// Check the settings make sense together
+func checkSettings() error {
+	switch {
+	case cfg.Sec.MinPos <= 0:
+		return errors.New("minPos must be above 0")
+	case cfg.Sec.MaxPos < cfg.Sec.MinPos:
+		return fmt.Errorf("maxPos must be at least minPos %g", cfg.Sec.MinPos)
+	case cfg.Sec.ExitPercent > 1:
+		return errors.New("exitPercent must be at most 1")
+	}
+
+	return nil
+}
+
+// Multiply the quoted edge by a factor such as 2x, 1x quoting as configured,
+// and requote
+func widen(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: widen <factor>x")
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(args[0]), "x"), 64)
+	if err != nil || !(factor > 0 && factor <= maxWidening) {
+		return "", fmt.Errorf("widening must be a factor above 0 and at most %d, e.g. 2x, not %q", maxWidening, args[0])
+	}
+	widening = factor
+	orderTheo = 0
+
+	return fmt.Sprintf("quotes widened %gx", factor), nil
+}
+
+// Summarise the quoting state
+func status(theo, position float64) string {
+	state := "quoting"
+	if paused {
+		state = "paused"
+	}
+
+	return fmt.Sprintf("%s, widened %gx, maxPos %g, minEdge %g, position %.4f, theo %.4f, %d orders",
+		state, widening, cfg.Sec.MaxPos, cfg.Sec.MinEdge, position, theo, len(quoter.Orders()))
+}
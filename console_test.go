@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bitmm/risk"
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	a := crashedSession(t, orphansCancel)
+	preTrade = risk.NewPreTrade(orderLimits())
+	var audit bytes.Buffer
+	log.SetOutput(&audit)
+	defer log.SetOutput(os.Stderr)
+
+	for _, line := range []string{"", "bogus", "status now", "set maxPos", "set maxPos abc", "set maxPos 0.01", "set nonce 5", "widen 0x", "widen 11x", "resume"} {
+		if runCommand(line, 250, 2) || !strings.Contains(lastReply, "rejected") {
+			t.Fatalf("Expected %q rejected, got %s", line, lastReply)
+		}
+	}
+	if cfg.Sec.MaxPos != 10 || widening != 1 || paused {
+		t.Fatal("Expected rejected commands to change nothing")
+	}
+
+	runCommand("SET maxpos 5", 250, 2)
+	if cfg.Sec.MaxPos != 5 || preTrade.Limits.MaxPosition != 5 {
+		t.Fatalf("Expected maxPos set, got %s", lastReply)
+	}
+	runCommand("widen 2x", 250, 2)
+	if widening != 2 {
+		t.Fatalf("Expected quotes widened, got %s", lastReply)
+	}
+	if params := calculateOrderParams(0, 250, 0); params[0].Price != 250-2*cfg.Sec.MinEdge {
+		t.Fatalf("Expected widened quotes, got %+v", params)
+	}
+
+	runCommand("pause", 250, 2)
+	if orders, _ := a.ActiveOrdersContext(context.Background()); !paused || len(orders) != 0 {
+		t.Fatalf("Expected orders cancelled and quoting paused, got %+v", orders)
+	}
+	runCommand("resume", 250, 2)
+	runCommand("flatten", 250, 2)
+	if positions, _ := a.ActivePositionsContext(context.Background()); !paused || len(positions) != 0 {
+		t.Fatalf("Expected position flattened and quoting paused, got %+v", positions)
+	}
+	runCommand("resume", 250, 0)
+	if paused {
+		t.Fatalf("Expected quoting resumed, got %s", lastReply)
+	}
+	if !runCommand(" quit ", 250, 0) {
+		t.Fatal("Expected quit")
+	}
+
+	// Every command is audited, rejected or not
+	if n := strings.Count(audit.String(), "Audit: operator command"); n != 17 {
+		t.Fatalf("Expected 17 audit entries, got %d:\n%s", n, audit.String())
+	}
+	paused, widening = false, 1
+}
@@ -0,0 +1,84 @@
+// Exchange-agnostic interface used by the strategy
+
+package exchange
+
+import (
+	"bitmm/bitfinex"
+	"context"
+	"math"
+)
+
+// Exchange is a venue the strategy can trade on, e.g. a bitfinex.Client, a
+// simulator or a paper trading account. Market data and orders use the
+// bitfinex types as the common format.
+type Exchange interface {
+	MarketData
+	Trading
+	Account
+}
+
+// MarketData provides public market data
+type MarketData interface {
+	TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error)
+	OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error)
+}
+
+// Trading places, cancels, replaces and queries orders
+type Trading interface {
+	NewOrderContext(ctx context.Context, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error)
+	MultipleNewOrdersContext(ctx context.Context, params []bitfinex.OrderParams) (bitfinex.Orders, error)
+	CancelOrderContext(ctx context.Context, id int) (bitfinex.Order, error)
+	CancelAllContext(ctx context.Context) (bool, error)
+	ReplaceOrderContext(ctx context.Context, id int, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error)
+	OrderStatusContext(ctx context.Context, id int) (bitfinex.Order, error)
+	ActiveOrdersContext(ctx context.Context) ([]bitfinex.Order, error)
+}
+
+// Account provides positions and balances
+type Account interface {
+	ActivePositionsContext(ctx context.Context) (bitfinex.Positions, error)
+	BalancesContext(ctx context.Context) (bitfinex.Balances, error)
+}
+
+// Budgeted is implemented by exchanges limiting the rate of requests. An
+// exchange without it has an unlimited budget.
+type Budgeted interface {
+	Budget() (public, authenticated float64)
+}
+
+// Streaming is a venue streaming market data and our fills as they happen
+type Streaming interface {
+	// StreamMarket streams trades and orderbooks of symbol until ctx is done
+	StreamMarket(ctx context.Context, symbol string, bookLength int) MarketStream
+	// StreamFills streams executions of our orders until ctx is done
+	StreamFills(ctx context.Context) FillStream
+}
+
+// MarketStream is a stream of trades and orderbooks
+type MarketStream struct {
+	Trades <-chan bitfinex.TradeEvent // Trades as they happen
+	Books  <-chan bitfinex.BookEvent  // Orderbook snapshots and updates
+	Errors <-chan error               // Connection problems
+	Resync func()                     // Requests fresh orderbook snapshots
+}
+
+// FillStream is a stream of executions of our orders
+type FillStream struct {
+	Fills  <-chan bitfinex.Fill // Executions as they happen
+	Errors <-chan error         // Connection and order problems
+}
+
+// Budget returns the remaining request budget of e, unlimited if it has none
+func Budget(e interface{}) (public, authenticated float64) {
+	if budgeted, ok := e.(Budgeted); ok {
+		return budgeted.Budget()
+	}
+
+	return math.Inf(1), math.Inf(1)
+}
+
+// Check bitfinex.Client satisfies Exchange and Budgeted
+var (
+	_ Exchange = bitfinex.Client{}
+	_ Budgeted = bitfinex.Client{}
+)
@@ -0,0 +1,36 @@
+// Streams over bitfinex's websocket API
+
+package exchange
+
+import (
+	"bitmm/bitfinex"
+	"context"
+)
+
+// Websocket streams market data and, authenticated by Client, our fills
+// over bitfinex's websocket API
+type Websocket struct {
+	Client bitfinex.Client
+}
+
+// Check Websocket satisfies Streaming
+var _ Streaming = Websocket{}
+
+// StreamMarket subscribes to the trades and orderbook of symbol and runs the
+// stream until ctx is done
+func (w Websocket) StreamMarket(ctx context.Context, symbol string, bookLength int) MarketStream {
+	stream := bitfinex.NewStream("")
+	stream.SubscribeTrades(symbol)
+	stream.SubscribeBook(symbol, bookLength)
+	go stream.Run(ctx)
+
+	return MarketStream{Trades: stream.Trades, Books: stream.Books, Errors: stream.Errors, Resync: stream.Resync}
+}
+
+// StreamFills runs an authenticated session until ctx is done
+func (w Websocket) StreamFills(ctx context.Context) FillStream {
+	session := bitfinex.NewSession(w.Client, "")
+	go session.Run(ctx)
+
+	return FillStream{Fills: session.Fills, Errors: session.Errors}
+}
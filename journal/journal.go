@@ -0,0 +1,532 @@
+// Journal of the inputs of a live session for deterministic replay
+//
+// A journal is newline-delimited JSON, one Entry per input in the order the
+// inputs were received: exchange responses, clock readings and events such as
+// streamed trades. Replaying asks for the same inputs in the same order; the
+// first input asked for that does not match the journal ends the replay.
+
+package journal
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/exchange"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrEnd is returned when a replay asks for more inputs than were journaled
+var ErrEnd = errors.New("journal: end of journal")
+
+// Entry is one journaled input
+type Entry struct {
+	Seq    int             `json:"seq"`              // Position in the journal, from 1
+	Kind   string          `json:"kind"`             // Input, e.g. "Trades", "Now" or "Fill"
+	Args   json.RawMessage `json:"args,omitempty"`   // Arguments of a call
+	Result json.RawMessage `json:"result,omitempty"` // Value returned or received
+	Err    string          `json:"err,omitempty"`    // Error returned
+	Class  []string        `json:"class,omitempty"`  // Classes of the error, from classes
+}
+
+// Error classes kept across replay, so callers checking errors.Is take the
+// same path as they did live
+var classes = []error{
+	bitfinex.ErrRateLimited,
+	bitfinex.ErrInvalidNonce,
+	bitfinex.ErrInsufficientMargin,
+	bitfinex.ErrUnknownOrder,
+	bitfinex.ErrAuth,
+	bitfinex.ErrRejected,
+	context.DeadlineExceeded,
+	context.Canceled,
+}
+
+// replayedError is a journaled error, matching its classes when journaled
+type replayedError struct {
+	msg     string
+	classes []error
+}
+
+// Error returns the journaled message
+func (err *replayedError) Error() string {
+	return err.msg
+}
+
+// Is reports whether the error matched target when journaled
+func (err *replayedError) Is(target error) bool {
+	for _, class := range err.classes {
+		if class == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DivergenceError reports a replay asking for an input other than the next
+// journaled one, e.g. a different order than was sent
+type DivergenceError struct {
+	Entry Entry           // Next journaled entry
+	Kind  string          // Input asked for
+	Args  json.RawMessage // Arguments asked with
+}
+
+// Events journals inputs received on channels, or consumes them when replaying
+type Events interface {
+	Event(kind string, data interface{}) error
+}
+
+// Clock provides the time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// System is the system clock
+type System struct{}
+
+// Writer journals inputs, safe for concurrent use
+type Writer struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	seq     int
+	err     error // First write error
+}
+
+// Reader supplies journaled inputs in order, safe for concurrent use
+type Reader struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int   // Index of the next entry
+	err     error // Divergence or ErrEnd, after which nothing more is supplied
+}
+
+// Client is an exchange journaling every response
+type Client struct {
+	exchange exchange.Exchange
+	journal  *Writer
+}
+
+// Player is an exchange answering calls from a journal
+type Player struct {
+	journal *Reader
+}
+
+// clock journals the times read from a clock
+type clock struct {
+	Clock
+	journal *Writer
+}
+
+// NewWriter returns a writer journaling to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{encoder: json.NewEncoder(w)}
+}
+
+// NewReader reads a whole journal
+func NewReader(r io.Reader) (*Reader, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("journal: line %d: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Reader{entries: entries}, nil
+}
+
+// NewClient returns an exchange journaling the responses of ex to w
+func NewClient(ex exchange.Exchange, w *Writer) Client {
+	return Client{ex, w}
+}
+
+// NewPlayer returns an exchange answering from r
+func NewPlayer(r *Reader) Player {
+	return Player{r}
+}
+
+// NewClock returns a clock journaling the times read from c to w
+func NewClock(c Clock, w *Writer) Clock {
+	return clock{c, w}
+}
+
+// Error describes the divergence
+func (err *DivergenceError) Error() string {
+	return fmt.Sprintf("journal: entry %d is %s%s, replay asked for %s%s",
+		err.Entry.Seq, err.Entry.Kind, err.Entry.Args, err.Kind, err.Args)
+}
+
+// Now returns the current time
+func (System) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for d to elapse
+func (System) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Record journals an input, keeping the first write error for Err
+func (w *Writer) Record(kind string, args, result interface{}, err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	entry := Entry{Seq: w.seq, Kind: kind}
+	var merr error
+	if args != nil {
+		entry.Args, merr = json.Marshal(args)
+	}
+	if result != nil && merr == nil {
+		entry.Result, merr = json.Marshal(result)
+	}
+	if err != nil {
+		entry.Err = err.Error()
+		for _, class := range classes {
+			if errors.Is(err, class) {
+				entry.Class = append(entry.Class, class.Error())
+			}
+		}
+	}
+	if merr == nil {
+		merr = w.encoder.Encode(entry)
+	}
+	if merr != nil && w.err == nil {
+		w.err = merr
+	}
+
+	return merr
+}
+
+// Event journals data received as an input
+func (w *Writer) Event(kind string, data interface{}) error {
+	return w.Record(kind, nil, data, nil)
+}
+
+// Err returns the first error writing the journal
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Next consumes the next entry, which must be kind called with args, decoding
+// its value into result (if not nil) and returning its error
+func (r *Reader) Next(kind string, args, result interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.next >= len(r.entries) {
+		r.err = ErrEnd
+		return r.err
+	}
+	entry := r.entries[r.next]
+
+	var encoded json.RawMessage
+	if args != nil {
+		encoded, _ = json.Marshal(args)
+	}
+	if entry.Kind != kind || !bytes.Equal(entry.Args, encoded) {
+		r.err = &DivergenceError{entry, kind, encoded}
+		return r.err
+	}
+	r.next++
+
+	if result != nil && len(entry.Result) > 0 {
+		if err := json.Unmarshal(entry.Result, result); err != nil {
+			r.err = fmt.Errorf("journal: entry %d: %s", entry.Seq, err)
+			return r.err
+		}
+	}
+	if entry.Err != "" {
+		replayed := &replayedError{msg: entry.Err}
+		for _, class := range classes {
+			for _, name := range entry.Class {
+				if class.Error() == name {
+					replayed.classes = append(replayed.classes, class)
+				}
+			}
+		}
+		return replayed
+	}
+
+	return nil
+}
+
+// Event consumes a journaled input received on a channel
+func (r *Reader) Event(kind string, data interface{}) error {
+	return r.Next(kind, nil, nil)
+}
+
+// Following returns the entries of kind next in the journal, up to the first
+// of another kind, without consuming them
+func (r *Reader) Following(kind string) []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []Entry
+	for i := r.next; r.err == nil && i < len(r.entries) && r.entries[i].Kind == kind; i++ {
+		entries = append(entries, r.entries[i])
+	}
+
+	return entries
+}
+
+// Peek returns the next entry, ok is false at the end or after a divergence
+func (r *Reader) Peek() (entry Entry, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil || r.next >= len(r.entries) {
+		return Entry{}, false
+	}
+
+	return r.entries[r.next], true
+}
+
+// Err returns the divergence that ended the replay, ErrEnd if it ran past the
+// end of the journal, or nil
+func (r *Reader) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// Position returns the number of entries consumed and the total
+func (r *Reader) Position() (consumed, total int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.next, len(r.entries)
+}
+
+// Now returns and journals the current time
+func (c clock) Now() time.Time {
+	now := c.Clock.Now()
+	c.journal.Record("Now", nil, now, nil)
+
+	return now
+}
+
+// TradesContext journals the trades returned
+func (client Client) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	trades, err := client.exchange.TradesContext(ctx, symbol, limitTrades)
+	client.journal.Record("Trades", []interface{}{symbol, limitTrades}, trades, err)
+
+	return trades, err
+}
+
+// OrderbookContext journals the orderbook returned
+func (client Client) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	book, err := client.exchange.OrderbookContext(ctx, symbol, limitBids, limitAsks)
+	client.journal.Record("Orderbook", []interface{}{symbol, limitBids, limitAsks}, book, err)
+
+	return book, err
+}
+
+// NewOrderContext journals the order placed
+func (client Client) NewOrderContext(ctx context.Context, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	order, err := client.exchange.NewOrderContext(ctx, symbol, amount, price, exchange, side, otype)
+	client.journal.Record("NewOrder", []interface{}{symbol, amount, price, exchange, side, otype}, order, err)
+
+	return order, err
+}
+
+// MultipleNewOrdersContext journals the orders placed
+func (client Client) MultipleNewOrdersContext(ctx context.Context, params []bitfinex.OrderParams) (bitfinex.Orders, error) {
+	orders, err := client.exchange.MultipleNewOrdersContext(ctx, params)
+	client.journal.Record("MultipleNewOrders", params, orders, err)
+
+	return orders, err
+}
+
+// CancelOrderContext journals the order cancelled
+func (client Client) CancelOrderContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	order, err := client.exchange.CancelOrderContext(ctx, id)
+	client.journal.Record("CancelOrder", []interface{}{id}, order, err)
+
+	return order, err
+}
+
+// CancelAllContext journals the result of cancelling all orders
+func (client Client) CancelAllContext(ctx context.Context) (bool, error) {
+	cancelled, err := client.exchange.CancelAllContext(ctx)
+	client.journal.Record("CancelAll", nil, cancelled, err)
+
+	return cancelled, err
+}
+
+// ReplaceOrderContext journals the replacement order
+func (client Client) ReplaceOrderContext(ctx context.Context, id int, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	order, err := client.exchange.ReplaceOrderContext(ctx, id, symbol, amount, price, exchange, side, otype)
+	client.journal.Record("ReplaceOrder", []interface{}{id, symbol, amount, price, exchange, side, otype}, order, err)
+
+	return order, err
+}
+
+// OrderStatusContext journals the order status
+func (client Client) OrderStatusContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	order, err := client.exchange.OrderStatusContext(ctx, id)
+	client.journal.Record("OrderStatus", []interface{}{id}, order, err)
+
+	return order, err
+}
+
+// ActiveOrdersContext journals the active orders
+func (client Client) ActiveOrdersContext(ctx context.Context) ([]bitfinex.Order, error) {
+	orders, err := client.exchange.ActiveOrdersContext(ctx)
+	client.journal.Record("ActiveOrders", nil, orders, err)
+
+	return orders, err
+}
+
+// ActivePositionsContext journals the active positions
+func (client Client) ActivePositionsContext(ctx context.Context) (bitfinex.Positions, error) {
+	positions, err := client.exchange.ActivePositionsContext(ctx)
+	client.journal.Record("ActivePositions", nil, positions, err)
+
+	return positions, err
+}
+
+// BalancesContext journals the balances
+func (client Client) BalancesContext(ctx context.Context) (bitfinex.Balances, error) {
+	balances, err := client.exchange.BalancesContext(ctx)
+	client.journal.Record("Balances", nil, balances, err)
+
+	return balances, err
+}
+
+// Budget journals the remaining request budget
+func (client Client) Budget() (public, authenticated float64) {
+	public, authenticated = exchange.Budget(client.exchange)
+	// JSON has no infinity, an unlimited budget is journaled as the largest number
+	client.journal.Record("Budget", nil, []float64{math.Min(public, math.MaxFloat64), math.Min(authenticated, math.MaxFloat64)}, nil)
+
+	return public, authenticated
+}
+
+// TradesContext returns the journaled trades
+func (player Player) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	var trades bitfinex.Trades
+	err := player.journal.Next("Trades", []interface{}{symbol, limitTrades}, &trades)
+
+	return trades, err
+}
+
+// OrderbookContext returns the journaled orderbook
+func (player Player) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	var book bitfinex.Book
+	err := player.journal.Next("Orderbook", []interface{}{symbol, limitBids, limitAsks}, &book)
+
+	return book, err
+}
+
+// NewOrderContext returns the journaled order
+func (player Player) NewOrderContext(ctx context.Context, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	var order bitfinex.Order
+	err := player.journal.Next("NewOrder", []interface{}{symbol, amount, price, exchange, side, otype}, &order)
+
+	return order, err
+}
+
+// MultipleNewOrdersContext returns the journaled orders
+func (player Player) MultipleNewOrdersContext(ctx context.Context, params []bitfinex.OrderParams) (bitfinex.Orders, error) {
+	var orders bitfinex.Orders
+	err := player.journal.Next("MultipleNewOrders", params, &orders)
+
+	return orders, err
+}
+
+// CancelOrderContext returns the journaled cancelled order
+func (player Player) CancelOrderContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	var order bitfinex.Order
+	err := player.journal.Next("CancelOrder", []interface{}{id}, &order)
+
+	return order, err
+}
+
+// CancelAllContext returns the journaled result of cancelling all orders
+func (player Player) CancelAllContext(ctx context.Context) (bool, error) {
+	var cancelled bool
+	err := player.journal.Next("CancelAll", nil, &cancelled)
+
+	return cancelled, err
+}
+
+// ReplaceOrderContext returns the journaled replacement order
+func (player Player) ReplaceOrderContext(ctx context.Context, id int, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	var order bitfinex.Order
+	err := player.journal.Next("ReplaceOrder", []interface{}{id, symbol, amount, price, exchange, side, otype}, &order)
+
+	return order, err
+}
+
+// OrderStatusContext returns the journaled order status
+func (player Player) OrderStatusContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	var order bitfinex.Order
+	err := player.journal.Next("OrderStatus", []interface{}{id}, &order)
+
+	return order, err
+}
+
+// ActiveOrdersContext returns the journaled active orders
+func (player Player) ActiveOrdersContext(ctx context.Context) ([]bitfinex.Order, error) {
+	var orders []bitfinex.Order
+	err := player.journal.Next("ActiveOrders", nil, &orders)
+
+	return orders, err
+}
+
+// ActivePositionsContext returns the journaled active positions
+func (player Player) ActivePositionsContext(ctx context.Context) (bitfinex.Positions, error) {
+	var positions bitfinex.Positions
+	err := player.journal.Next("ActivePositions", nil, &positions)
+
+	return positions, err
+}
+
+// BalancesContext returns the journaled balances
+func (player Player) BalancesContext(ctx context.Context) (bitfinex.Balances, error) {
+	var balances bitfinex.Balances
+	err := player.journal.Next("Balances", nil, &balances)
+
+	return balances, err
+}
+
+// Budget returns the journaled request budget, none once the replay has ended
+func (player Player) Budget() (public, authenticated float64) {
+	var budget []float64
+	if player.journal.Next("Budget", nil, &budget) != nil || len(budget) != 2 {
+		return 0, 0
+	}
+
+	return budget[0], budget[1]
+}
+
+// Check Client and Player satisfy exchange.Exchange
+var (
+	_ exchange.Exchange = Client{}
+	_ exchange.Exchange = Player{}
+)
@@ -0,0 +1,99 @@
+package journal
+
+import (
+	"bitmm/bitfinex"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// fixed answers with fixed data
+type fixed struct {
+	Player
+}
+
+func (fixed) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	return bitfinex.Trades{{TID: 1, Price: 250.1, Amount: 0.5}}, nil
+}
+
+func (fixed) CancelAllContext(ctx context.Context) (bool, error) {
+	return false, errors.New("cancel failed")
+}
+
+func (fixed) CancelOrderContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	return bitfinex.Order{}, fmt.Errorf("order %d: %w", id, bitfinex.ErrUnknownOrder)
+}
+
+func (fixed) Budget() (public, authenticated float64) {
+	return 10, math.Inf(1)
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	client := NewClient(fixed{}, w)
+	now := NewClock(System{}, w).Now()
+	client.TradesContext(ctx, "btcusd", 50)
+	client.CancelAllContext(ctx)
+	client.CancelOrderContext(ctx, 7)
+	client.Budget()
+	w.Event("Input", nil)
+	if w.Err() != nil {
+		t.Fatal(w.Err())
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	player := NewPlayer(r)
+	var replayed time.Time
+	if err := r.Next("Now", nil, &replayed); err != nil || !replayed.Equal(now) {
+		t.Fatalf("Unexpected time %v %v", replayed, err)
+	}
+	trades, err := player.TradesContext(ctx, "btcusd", 50)
+	if err != nil || len(trades) != 1 || trades[0].Price != 250.1 {
+		t.Fatalf("Unexpected trades %+v %v", trades, err)
+	}
+	if cancelled, err := player.CancelAllContext(ctx); cancelled || err == nil || err.Error() != "cancel failed" {
+		t.Fatalf("Unexpected cancel %v %v", cancelled, err)
+	}
+	if _, err := player.CancelOrderContext(ctx, 7); !errors.Is(err, bitfinex.ErrUnknownOrder) || err.Error() != "order 7: bitfinex: unknown order" {
+		t.Fatalf("Expected unknown order error, got %v", err)
+	}
+	if public, authenticated := player.Budget(); public != 10 || authenticated != math.MaxFloat64 {
+		t.Fatalf("Unexpected budget %v %v", public, authenticated)
+	}
+	if entry, ok := r.Peek(); !ok || entry.Kind != "Input" {
+		t.Fatalf("Unexpected next entry %+v", entry)
+	}
+	r.Event("Input", nil)
+	if consumed, total := r.Position(); consumed != 6 || total != 6 || r.Err() != nil {
+		t.Fatalf("Unexpected position %d of %d", consumed, total)
+	}
+	if _, err := player.ActiveOrdersContext(ctx); err != ErrEnd {
+		t.Fatal("Expected end of journal, got", err)
+	}
+}
+
+func TestDivergence(t *testing.T) {
+	var buf bytes.Buffer
+	NewClient(fixed{}, NewWriter(&buf)).TradesContext(context.Background(), "btcusd", 50)
+
+	r, _ := NewReader(&buf)
+	_, err := NewPlayer(r).TradesContext(context.Background(), "btcusd", 25)
+	var divergence *DivergenceError
+	if !errors.As(err, &divergence) || divergence.Entry.Seq != 1 || string(divergence.Args) != `["btcusd",25]` {
+		t.Fatal("Expected divergence, got", err)
+	}
+
+	// Nothing more is supplied after a divergence
+	if _, ok := r.Peek(); ok || r.Err() != err {
+		t.Fatal("Expected replay to stop")
+	}
+}
@@ -0,0 +1,485 @@
+// Simulated trading account filling orders against live market data
+
+package paper
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/exchange"
+	"bitmm/pnl"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Currency of the simulated balance
+const currency = "usd"
+
+// Errors for orders the simulated exchange rejects
+var (
+	ErrInvalidOrder error = rejection("paper: invalid order")
+	ErrNoPrice      error = rejection("paper: no trade price for market order")
+)
+
+// rejection is an order refused by the simulated exchange, matching
+// bitfinex.ErrRejected like an order refused by the exchange
+type rejection string
+
+// Account is a simulated exchange account. Market data comes from Market and
+// resting limit orders are filled when later market trades cross them. Orders
+// never fill against trades seen before they were placed.
+type Account struct {
+	Market exchange.MarketData // Source of public trades and orderbooks
+	Fills  chan bitfinex.Fill  // Simulated executions, queued until read
+
+	mu        sync.Mutex
+	orders    map[int]*bitfinex.Order // All orders by ID
+	nextID    int
+	positions map[string]*bitfinex.Position // Positions by symbol
+	lastTID   map[string]int                // Latest trade ID seen by symbol
+	lastPrice map[string]float64            // Latest trade price by symbol
+	balance   float64                       // Starting balance
+	realized  float64                       // Realized P&L
+	nextTID   int
+	queued    []bitfinex.Fill // Fills waiting for room in Fills
+}
+
+// New returns an account starting with balance USD and no positions
+func New(market exchange.MarketData, balance float64) *Account {
+	return &Account{
+		Market:    market,
+		Fills:     make(chan bitfinex.Fill, 100),
+		orders:    make(map[int]*bitfinex.Order),
+		positions: make(map[string]*bitfinex.Position),
+		lastTID:   make(map[string]int),
+		lastPrice: make(map[string]float64),
+		balance:   balance,
+	}
+}
+
+// Check Account satisfies exchange.Exchange
+var _ exchange.Exchange = (*Account)(nil)
+
+// TradesContext returns trades from Market, filling orders they cross
+func (account *Account) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	trades, err := account.Market.TradesContext(ctx, symbol, limitTrades)
+	if err != nil {
+		return trades, err
+	}
+	account.Match(symbol, trades)
+
+	return trades, nil
+}
+
+// OrderbookContext returns the orderbook from Market
+func (account *Account) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	return account.Market.OrderbookContext(ctx, symbol, limitBids, limitAsks)
+}
+
+// Match fills orders against trades, newest first as returned by the
+// exchange. Only trades newer than any seen before are used; the first trades
+// seen for a symbol just mark where matching starts.
+func (account *Account) Match(symbol string, trades bitfinex.Trades) {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	last, seen := account.lastTID[symbol]
+	for i := len(trades) - 1; i >= 0; i-- {
+		trade := trades[i]
+		if seen && trade.TID <= last {
+			continue
+		}
+		if seen {
+			account.match(symbol, trade)
+		}
+		account.lastTID[symbol] = trade.TID
+		account.lastPrice[symbol] = trade.Price
+	}
+	account.mark(symbol)
+}
+
+// NewOrderContext places a simulated order. Limit orders rest until trades
+// cross them, market orders fill at the last trade price.
+func (account *Account) NewOrderContext(ctx context.Context, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return bitfinex.Order{}, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	return account.newOrder(symbol, amount, price, exchange, side, otype)
+}
+
+// MultipleNewOrdersContext places several simulated orders, none if any is invalid
+func (account *Account) MultipleNewOrdersContext(ctx context.Context, params []bitfinex.OrderParams) (bitfinex.Orders, error) {
+	if err := ctx.Err(); err != nil {
+		return bitfinex.Orders{}, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	for _, p := range params {
+		if err := account.validate(p.Symbol, p.Amount, p.Price, p.Side, p.Type); err != nil {
+			return bitfinex.Orders{}, err
+		}
+	}
+	orders := bitfinex.Orders{Orders: make([]bitfinex.Order, 0, len(params))}
+	for _, p := range params {
+		order, err := account.newOrder(p.Symbol, p.Amount, p.Price, p.Exchange, p.Side, p.Type)
+		if err != nil {
+			return orders, err
+		}
+		orders.Orders = append(orders.Orders, order)
+	}
+
+	return orders, nil
+}
+
+// CancelOrderContext cancels a live simulated order
+func (account *Account) CancelOrderContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return bitfinex.Order{}, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	order, err := account.live(id)
+	if err != nil {
+		return bitfinex.Order{}, err
+	}
+	cancel(order)
+
+	return *order, nil
+}
+
+// CancelAllContext cancels all live simulated orders
+func (account *Account) CancelAllContext(ctx context.Context) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	for _, order := range account.orders {
+		if order.IsLive {
+			cancel(order)
+		}
+	}
+
+	return true, nil
+}
+
+// ReplaceOrderContext cancels a live simulated order and places a new one
+func (account *Account) ReplaceOrderContext(ctx context.Context, id int, symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return bitfinex.Order{}, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	order, err := account.live(id)
+	if err != nil {
+		return bitfinex.Order{}, err
+	}
+	if err := account.validate(symbol, amount, price, side, otype); err != nil {
+		return bitfinex.Order{}, err
+	}
+	cancel(order)
+
+	return account.newOrder(symbol, amount, price, exchange, side, otype)
+}
+
+// OrderStatusContext returns a simulated order
+func (account *Account) OrderStatusContext(ctx context.Context, id int) (bitfinex.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return bitfinex.Order{}, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	order, ok := account.orders[id]
+	if !ok {
+		return bitfinex.Order{}, fmt.Errorf("paper: order %d: %w", id, bitfinex.ErrUnknownOrder)
+	}
+
+	return *order, nil
+}
+
+// ActiveOrdersContext returns live simulated orders, oldest first
+func (account *Account) ActiveOrdersContext(ctx context.Context) ([]bitfinex.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	orders := []bitfinex.Order{}
+	for _, order := range account.orders {
+		if order.IsLive {
+			orders = append(orders, *order)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+
+	return orders, nil
+}
+
+// ActivePositionsContext returns open simulated positions with P&L marked to
+// the last trade price
+func (account *Account) ActivePositionsContext(ctx context.Context) (bitfinex.Positions, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	positions := bitfinex.Positions{}
+	for _, position := range account.positions {
+		if position.Amount != 0 {
+			positions = append(positions, *position)
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Symbol < positions[j].Symbol })
+
+	return positions, nil
+}
+
+// BalancesContext returns the simulated USD trading balance, the starting
+// balance plus realized P&L
+func (account *Account) BalancesContext(ctx context.Context) (bitfinex.Balances, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	balance := account.balance + account.realized
+
+	return bitfinex.Balances{{Type: "trading", Currency: currency, Amount: balance, Available: balance}}, nil
+}
+
+// Budget returns the public budget of Market, if it has one, and an unlimited
+// authenticated budget
+func (account *Account) Budget() (public, authenticated float64) {
+	public = math.Inf(1)
+	if market, ok := account.Market.(exchange.Budgeted); ok {
+		public, _ = market.Budget()
+	}
+
+	return public, math.Inf(1)
+}
+
+// PL returns realized P&L and unrealized P&L at the last trade prices
+func (account *Account) PL() (realized, unrealized float64) {
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	for _, position := range account.positions {
+		unrealized += position.PL
+	}
+
+	return account.realized, unrealized
+}
+
+// validate checks an order can be placed
+func (account *Account) validate(symbol string, amount, price float64, side, otype string) error {
+	if symbol == "" || amount <= 0 || (side != "buy" && side != "sell") {
+		return fmt.Errorf("%w: %s %v %s", ErrInvalidOrder, side, amount, symbol)
+	}
+	switch otype {
+	case "limit":
+		if price <= 0 {
+			return fmt.Errorf("%w: limit price %v", ErrInvalidOrder, price)
+		}
+	case "market":
+		if _, ok := account.lastPrice[symbol]; !ok {
+			return ErrNoPrice
+		}
+	default:
+		return fmt.Errorf("%w: unsupported type %q", ErrInvalidOrder, otype)
+	}
+
+	return nil
+}
+
+// newOrder places a validated order, filling it at once if it is a market order
+func (account *Account) newOrder(symbol string, amount, price float64, exchange, side, otype string) (bitfinex.Order, error) {
+	if err := account.validate(symbol, amount, price, side, otype); err != nil {
+		return bitfinex.Order{}, err
+	}
+
+	account.nextID++
+	order := &bitfinex.Order{
+		ID:              account.nextID,
+		Symbol:          symbol,
+		Exchange:        exchange,
+		Price:           price,
+		Side:            side,
+		Type:            otype,
+		Timestamp:       float64(time.Now().UnixNano()) / 1e9,
+		IsLive:          true,
+		OriginalAmount:  amount,
+		RemainingAmount: amount,
+		Amount:          amount,
+		Status:          "ACTIVE",
+	}
+	account.orders[order.ID] = order
+
+	if otype == "market" {
+		account.fill(order, amount, account.lastPrice[symbol], false)
+		account.mark(symbol)
+	}
+
+	return *order, nil
+}
+
+// live returns a live order by ID
+func (account *Account) live(id int) (*bitfinex.Order, error) {
+	order, ok := account.orders[id]
+	if !ok || !order.IsLive {
+		return nil, fmt.Errorf("paper: order %d: %w", id, bitfinex.ErrUnknownOrder)
+	}
+
+	return order, nil
+}
+
+// match fills live orders for symbol that trade crosses, oldest first, up to
+// the traded amount
+func (account *Account) match(symbol string, trade bitfinex.Trade) {
+	var crossed []*bitfinex.Order
+	for _, order := range account.orders {
+		if order.IsLive && order.Symbol == symbol &&
+			((order.Side == "buy" && trade.Price < order.Price) ||
+				(order.Side == "sell" && trade.Price > order.Price)) {
+			crossed = append(crossed, order)
+		}
+	}
+	sort.Slice(crossed, func(i, j int) bool { return crossed[i].ID < crossed[j].ID })
+
+	remaining := trade.Amount
+	for _, order := range crossed {
+		if remaining <= 0 {
+			break
+		}
+		amount := math.Min(remaining, order.RemainingAmount)
+		account.fill(order, amount, order.Price, true)
+		remaining -= amount
+	}
+}
+
+// fill executes amount of order at price, updating the order and position
+func (account *Account) fill(order *bitfinex.Order, amount, price float64, maker bool) {
+	executed := order.ExecutedAmount + amount
+	order.ExecutionPrice = (order.ExecutionPrice*order.ExecutedAmount + price*amount) / executed
+	order.AvgPrice = order.ExecutionPrice
+	order.ExecutedAmount = executed
+	order.RemainingAmount = order.OriginalAmount - executed
+	if order.RemainingAmount < 1e-12 {
+		order.RemainingAmount = 0
+		order.IsLive = false
+		order.Status = fmt.Sprintf("EXECUTED @ %v(%v)", price, executed)
+	} else {
+		order.Status = fmt.Sprintf("PARTIALLY FILLED @ %v(%v)", price, executed)
+	}
+	order.Amount = order.RemainingAmount
+
+	signed := amount
+	if order.Side == "sell" {
+		signed = -amount
+	}
+	account.trade(order.Symbol, signed, price)
+
+	account.nextTID++
+	fill := bitfinex.Fill{
+		ID:          account.nextTID,
+		OrderID:     order.ID,
+		Symbol:      order.Symbol,
+		Timestamp:   float64(time.Now().UnixNano()) / 1e9,
+		Amount:      signed,
+		Price:       price,
+		Maker:       maker,
+		FeeCurrency: strings.ToUpper(currency),
+	}
+	account.deliver(fill)
+}
+
+// deliver sends fill on Fills if there is room and none are queued, otherwise
+// queues it for a goroutine sending queued fills in order as Fills is read.
+// Called with the lock held.
+func (account *Account) deliver(fill bitfinex.Fill) {
+	if len(account.queued) == 0 {
+		select {
+		case account.Fills <- fill:
+			return
+		default:
+			go account.sendQueued()
+		}
+	}
+	account.queued = append(account.queued, fill)
+}
+
+// sendQueued sends the queued fills on Fills until none are left
+func (account *Account) sendQueued() {
+	for {
+		account.mu.Lock()
+		if len(account.queued) == 0 {
+			account.mu.Unlock()
+			return
+		}
+		fill := account.queued[0]
+		account.mu.Unlock()
+
+		account.Fills <- fill
+
+		account.mu.Lock()
+		account.queued = account.queued[1:]
+		account.mu.Unlock()
+	}
+}
+
+// trade updates the symbol's position for a signed amount traded at price,
+// realizing P&L on any amount that reduces the position
+func (account *Account) trade(symbol string, amount, price float64) {
+	position := account.positions[symbol]
+	if position == nil {
+		position = &bitfinex.Position{ID: len(account.positions) + 1, Symbol: symbol, Status: "ACTIVE"}
+		account.positions[symbol] = position
+	}
+
+	inventory := pnl.Inventory{Amount: position.Amount, Price: position.Base}
+	account.realized += inventory.Trade(amount, price)
+	if position.Amount == 0 || (inventory.Amount != 0 && (inventory.Amount > 0) != (position.Amount > 0)) {
+		// Opened or reversed
+		position.Timestamp = float64(time.Now().Unix())
+	}
+	position.Amount, position.Base = inventory.Amount, inventory.Price
+}
+
+// mark updates the unrealized P&L of the symbol's position to the last trade price
+func (account *Account) mark(symbol string) {
+	position, price := account.positions[symbol], account.lastPrice[symbol]
+	if position == nil || price == 0 {
+		return
+	}
+	position.PL = position.Amount * (price - position.Base)
+}
+
+// cancel marks an order cancelled
+func cancel(order *bitfinex.Order) {
+	order.IsLive = false
+	order.IsCancelled = true
+	order.Status = "CANCELED"
+}
+
+// Error returns the reason for the rejection
+func (err rejection) Error() string {
+	return string(err)
+}
+
+// Is matches bitfinex.ErrRejected
+func (err rejection) Is(target error) bool {
+	return target == bitfinex.ErrRejected
+}
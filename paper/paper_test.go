@@ -0,0 +1,173 @@
+package paper
+
+import (
+	"bitmm/bitfinex"
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+// market returns its trades, newest first
+type market struct {
+	trades bitfinex.Trades
+}
+
+func (m *market) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	return m.trades, nil
+}
+
+func (m *market) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	return bitfinex.Book{}, nil
+}
+
+// add prepends a trade
+func (m *market) add(tid int, price, amount float64) {
+	m.trades = append(bitfinex.Trades{{TID: tid, Price: price, Amount: amount}}, m.trades...)
+}
+
+func TestAccount(t *testing.T) {
+	ctx := context.Background()
+	m := &market{}
+	m.add(1, 250, 1)
+	account := New(m, 1000)
+
+	// Trades seen before any orders never fill
+	if _, err := account.TradesContext(ctx, "btcusd", 50); err != nil {
+		t.Fatal(err)
+	}
+	orders, err := account.MultipleNewOrdersContext(ctx, []bitfinex.OrderParams{
+		{"btcusd", 2, 249, "bitfinex", "buy", "limit"},
+		{"btcusd", 2, 251, "bitfinex", "sell", "limit"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders.Orders) != 2 || orders.Orders[0].ID == 0 || !orders.Orders[0].IsLive {
+		t.Fatalf("Unexpected orders %+v", orders)
+	}
+	buy, sell := orders.Orders[0].ID, orders.Orders[1].ID
+
+	// Touching the price does not fill, trading through it fills up to the trade size
+	m.add(2, 249, 5)
+	m.add(3, 248.5, 1.5)
+	account.TradesContext(ctx, "btcusd", 50)
+	order, _ := account.OrderStatusContext(ctx, buy)
+	if !order.IsLive || order.ExecutedAmount != 1.5 || order.RemainingAmount != 0.5 {
+		t.Fatalf("Expected partial fill, got %+v", order)
+	}
+	positions, _ := account.ActivePositionsContext(ctx)
+	if len(positions) != 1 || positions[0].Amount != 1.5 || positions[0].Base != 249 || positions[0].PL != -0.75 {
+		t.Fatalf("Unexpected positions %+v", positions)
+	}
+	fill := <-account.Fills
+	if fill.OrderID != buy || fill.Amount != 1.5 || fill.Price != 249 || !fill.Maker {
+		t.Fatalf("Unexpected fill %+v", fill)
+	}
+
+	// Seen trades are not matched again
+	account.TradesContext(ctx, "btcusd", 50)
+	if order, _ := account.OrderStatusContext(ctx, buy); order.ExecutedAmount != 1.5 {
+		t.Fatal("Trade matched twice")
+	}
+
+	// Selling realizes P&L and reverses the position
+	m.add(4, 252, 3)
+	account.TradesContext(ctx, "btcusd", 50)
+	if order, _ := account.OrderStatusContext(ctx, sell); order.IsLive || order.ExecutedAmount != 2 {
+		t.Fatalf("Expected sell executed, got %+v", order)
+	}
+	positions, _ = account.ActivePositionsContext(ctx)
+	if len(positions) != 1 || positions[0].Amount != -0.5 || positions[0].Base != 251 {
+		t.Fatalf("Unexpected positions %+v", positions)
+	}
+	realized, unrealized := account.PL()
+	if realized != 3 || unrealized != -0.5 {
+		t.Fatalf("Unexpected P&L %v %v", realized, unrealized)
+	}
+	balances, _ := account.BalancesContext(ctx)
+	if len(balances) != 1 || balances[0].Amount != 1003 {
+		t.Fatalf("Unexpected balances %+v", balances)
+	}
+
+	// Cancel the rest
+	if cancelled, err := account.CancelAllContext(ctx); !cancelled || err != nil {
+		t.Fatal("CancelAll failed", err)
+	}
+	if active, _ := account.ActiveOrdersContext(ctx); len(active) != 0 {
+		t.Fatalf("Orders still live %+v", active)
+	}
+	if _, err := account.CancelOrderContext(ctx, buy); !errors.Is(err, bitfinex.ErrUnknownOrder) {
+		t.Fatal("Expected unknown order, got", err)
+	}
+	m.add(5, 240, 10)
+	account.TradesContext(ctx, "btcusd", 50)
+	if order, _ := account.OrderStatusContext(ctx, buy); order.ExecutedAmount != 1.5 || !order.IsCancelled {
+		t.Fatalf("Cancelled order filled %+v", order)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	ctx := context.Background()
+	m := &market{}
+	account := New(m, 0)
+
+	// Market orders need a price, invalid orders are rejected
+	if _, err := account.NewOrderContext(ctx, "btcusd", 1, 0, "bitfinex", "buy", "market"); err != ErrNoPrice {
+		t.Fatal("Expected no price, got", err)
+	}
+	if _, err := account.MultipleNewOrdersContext(ctx, []bitfinex.OrderParams{
+		{"btcusd", 1, 250, "bitfinex", "buy", "limit"},
+		{"btcusd", -1, 250, "bitfinex", "sell", "limit"},
+	}); !errors.Is(err, ErrInvalidOrder) {
+		t.Fatal("Expected invalid order, got", err)
+	}
+	if active, _ := account.ActiveOrdersContext(ctx); len(active) != 0 {
+		t.Fatal("Orders placed despite invalid order")
+	}
+
+	m.add(1, 250, 1)
+	account.TradesContext(ctx, "btcusd", 50)
+	order, err := account.NewOrderContext(ctx, "btcusd", 1, 0, "bitfinex", "sell", "market")
+	if err != nil || order.IsLive || order.ExecutionPrice != 250 {
+		t.Fatalf("Unexpected market order %+v %v", order, err)
+	}
+
+	// Replace a limit order
+	order, _ = account.NewOrderContext(ctx, "btcusd", 1, 240, "bitfinex", "buy", "limit")
+	replaced, err := account.ReplaceOrderContext(ctx, order.ID, "btcusd", 2, 245, "bitfinex", "buy", "limit")
+	if err != nil || replaced.ID == order.ID || replaced.Price != 245 {
+		t.Fatalf("Unexpected replacement %+v %v", replaced, err)
+	}
+	if old, _ := account.OrderStatusContext(ctx, order.ID); !old.IsCancelled {
+		t.Fatal("Replaced order still live")
+	}
+
+	public, authenticated := account.Budget()
+	if !math.IsInf(public, 1) || !math.IsInf(authenticated, 1) {
+		t.Fatal("Expected unlimited budget")
+	}
+}
+
+func TestFillsQueued(t *testing.T) {
+	ctx := context.Background()
+	m := &market{}
+	m.add(1, 250, 1)
+	account := New(m, 1000)
+	account.Fills = make(chan bitfinex.Fill, 1)
+	account.TradesContext(ctx, "btcusd", 50)
+	for _, price := range []float64{249, 248, 247} {
+		if _, err := account.NewOrderContext(ctx, "btcusd", 1, price, "bitfinex", "buy", "limit"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fills beyond the room in Fills are sent in order as it is read
+	m.add(2, 246, 5)
+	account.TradesContext(ctx, "btcusd", 50)
+	for _, price := range []float64{249, 248, 247} {
+		if fill := <-account.Fills; fill.Price != price {
+			t.Fatalf("Expected fill at %.0f, got %+v", price, fill)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+// Profit and loss and inventory accounting from fills
+
+package pnl
+
+import (
+	"bitmm/bitfinex"
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the keys of daily totals, UTC dates
+const dayLayout = "2006-01-02"
+
+// Amounts smaller than this are treated as zero
+const epsilon = 1e-12
+
+// Inventory is a position with its average entry price
+type Inventory struct {
+	Amount float64 `json:"amount"` // Position, positive when long
+	Price  float64 `json:"price"`  // Average entry price, 0 when flat
+}
+
+// Totals summarises fills over a period
+type Totals struct {
+	Fills    int     `json:"fills"`    // Number of fills
+	Realized float64 `json:"realized"` // Realized P&L before fees
+	Fees     float64 `json:"fees"`     // Fees paid in the quote currency
+	Turnover float64 `json:"turnover"` // Traded value in the quote currency
+}
+
+// Ledger tracks inventory and P&L from fills, saving its state after each
+// fill if it has a file. Session totals start afresh with each Ledger.
+// Safe for concurrent use.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	session Totals
+	state   State
+	ahead   map[int]float64 // Amounts reconciled by order ID, not yet streamed
+}
+
+// State is the part of a ledger kept across restarts
+type State struct {
+	Inventory map[string]*Inventory `json:"inventory"` // Inventory by symbol
+	Days      map[string]*Totals    `json:"days"`      // Totals by UTC date
+}
+
+// Trade adds a signed amount traded at price, returning the P&L realized on
+// any amount that reduces the position. A zero amount changes nothing.
+func (inventory *Inventory) Trade(amount, price float64) (realized float64) {
+	if amount == 0 {
+		return 0
+	}
+	if inventory.Amount == 0 || (inventory.Amount > 0) == (amount > 0) {
+		// Opening or adding, average the entry price
+		total := math.Abs(inventory.Amount) + math.Abs(amount)
+		inventory.Price = (inventory.Price*math.Abs(inventory.Amount) + price*math.Abs(amount)) / total
+		inventory.Amount += amount
+		return 0
+	}
+
+	// Reducing, realize P&L on the closed amount
+	closed := math.Min(math.Abs(amount), math.Abs(inventory.Amount))
+	realized = closed * (price - inventory.Price)
+	if inventory.Amount < 0 {
+		realized = -realized
+	}
+	reversed := math.Abs(amount) > math.Abs(inventory.Amount)
+	inventory.Amount += amount
+	if math.Abs(inventory.Amount) < epsilon {
+		inventory.Amount, inventory.Price = 0, 0
+	} else if reversed {
+		// The remainder opens at price
+		inventory.Price = price
+	}
+
+	return realized
+}
+
+// Unrealized returns the P&L of the inventory marked to price
+func (inventory Inventory) Unrealized(mark float64) float64 {
+	return inventory.Amount * (mark - inventory.Price)
+}
+
+// New returns an empty ledger, saved to path if it is not empty
+func New(path string) *Ledger {
+	return &Ledger{
+		path:  path,
+		state: State{Inventory: make(map[string]*Inventory), Days: make(map[string]*Totals)},
+		ahead: make(map[int]float64),
+	}
+}
+
+// Restore returns a ledger with a copy of state, saved to path if it is not empty
+func Restore(path string, state State) *Ledger {
+	ledger := New(path)
+	for symbol, inventory := range state.Inventory {
+		copied := *inventory
+		ledger.state.Inventory[symbol] = &copied
+	}
+	for day, totals := range state.Days {
+		copied := *totals
+		ledger.state.Days[day] = &copied
+	}
+
+	return ledger
+}
+
+// Load returns a ledger restored from path, empty if the file does not exist
+func Load(path string) (*Ledger, error) {
+	ledger := New(path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ledger.state); err != nil {
+		return nil, err
+	}
+	if ledger.state.Inventory == nil {
+		ledger.state.Inventory = make(map[string]*Inventory)
+	}
+	if ledger.state.Days == nil {
+		ledger.state.Days = make(map[string]*Totals)
+	}
+
+	return ledger, nil
+}
+
+// Add accounts for a fill and saves the ledger. Any amount of the fill's
+// order already accounted by Reconciled only has its fee added, and fills of
+// no amount are ignored.
+func (ledger *Ledger) Add(fill bitfinex.Fill) error {
+	if math.Abs(fill.Amount) < epsilon {
+		return nil
+	}
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	if ahead := ledger.ahead[fill.OrderID]; fill.OrderID != 0 && ahead > 0 {
+		taken := math.Min(math.Abs(fill.Amount), ahead)
+		if ahead-taken < epsilon {
+			delete(ledger.ahead, fill.OrderID)
+		} else {
+			ledger.ahead[fill.OrderID] = ahead - taken
+		}
+		fill.Amount -= math.Copysign(taken, fill.Amount)
+	}
+	ledger.account(fill)
+
+	return ledger.save()
+}
+
+// Reconciled accounts for a fill found by checking its order with the
+// exchange before the fill was streamed, and saves the ledger. Streamed
+// fills of the order are then only counted beyond the amount found.
+func (ledger *Ledger) Reconciled(fill bitfinex.Fill) error {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	if fill.OrderID != 0 {
+		ledger.ahead[fill.OrderID] += math.Abs(fill.Amount)
+	}
+	ledger.account(fill)
+
+	return ledger.save()
+}
+
+// account adds a fill to the inventory and totals, only adding the fee if it
+// has no amount
+func (ledger *Ledger) account(fill bitfinex.Fill) {
+	traded := math.Abs(fill.Amount) >= epsilon
+	var realized float64
+	if traded {
+		inventory := ledger.state.Inventory[fill.Symbol]
+		if inventory == nil {
+			inventory = &Inventory{}
+			ledger.state.Inventory[fill.Symbol] = inventory
+		}
+		realized = inventory.Trade(fill.Amount, fill.Price)
+	}
+
+	// Fees are negative when paid, and may be charged in the base currency
+	fee := -fill.Fee
+	if fill.FeeCurrency != "" && !strings.HasSuffix(fill.Symbol, strings.ToLower(fill.FeeCurrency)) {
+		fee *= fill.Price
+	}
+
+	day := time.Unix(int64(fill.Timestamp), 0).UTC().Format(dayLayout)
+	totals := ledger.state.Days[day]
+	if totals == nil {
+		totals = &Totals{}
+		ledger.state.Days[day] = totals
+	}
+	for _, t := range []*Totals{&ledger.session, totals} {
+		t.Fees += fee
+		if traded {
+			t.Fills++
+			t.Realized += realized
+			t.Turnover += math.Abs(fill.Amount) * fill.Price
+		}
+	}
+}
+
+// Inventory returns the symbol's inventory
+func (ledger *Ledger) Inventory(symbol string) Inventory {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	if inventory := ledger.state.Inventory[symbol]; inventory != nil {
+		return *inventory
+	}
+
+	return Inventory{}
+}
+
+// SetInventory replaces the symbol's inventory, e.g. to match the exchange's
+// position, and saves the ledger
+func (ledger *Ledger) SetInventory(symbol string, inventory Inventory) error {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	ledger.state.Inventory[symbol] = &inventory
+
+	return ledger.save()
+}
+
+// State returns a copy of the state kept across restarts
+func (ledger *Ledger) State() State {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	return Restore("", ledger.state).state
+}
+
+// Session returns the totals of fills added since the ledger was created
+func (ledger *Ledger) Session() Totals {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	return ledger.session
+}
+
+// Day returns the totals of fills on the UTC date of t
+func (ledger *Ledger) Day(t time.Time) Totals {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	if totals := ledger.state.Days[t.UTC().Format(dayLayout)]; totals != nil {
+		return *totals
+	}
+
+	return Totals{}
+}
+
+// save writes the state to the ledger's file, if any, replacing it atomically
+func (ledger *Ledger) save() error {
+	if ledger.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ledger.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ledger.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ledger.path)
+}
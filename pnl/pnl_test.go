@@ -0,0 +1,126 @@
+package pnl
+
+import (
+	"bitmm/bitfinex"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInventory(t *testing.T) {
+	var inventory Inventory
+	if inventory.Trade(2, 250) != 0 || inventory.Trade(2, 252) != 0 || inventory.Amount != 4 || inventory.Price != 251 {
+		t.Fatalf("Unexpected inventory %+v", inventory)
+	}
+	if pl := inventory.Unrealized(250); pl != -4 {
+		t.Fatalf("Unexpected unrealized %v", pl)
+	}
+
+	// Reduce, then reverse
+	if pl := inventory.Trade(-1, 253); pl != 2 || inventory.Amount != 3 || inventory.Price != 251 {
+		t.Fatalf("Unexpected reduce %v %+v", pl, inventory)
+	}
+	if pl := inventory.Trade(-5, 250); pl != -3 || inventory.Amount != -2 || inventory.Price != 250 {
+		t.Fatalf("Unexpected reversal %v %+v", pl, inventory)
+	}
+	if pl := inventory.Trade(2, 249); pl != 2 || inventory.Amount != 0 || inventory.Price != 0 {
+		t.Fatalf("Unexpected close %v %+v", pl, inventory)
+	}
+
+	// Nothing traded while flat leaves it flat
+	if pl := inventory.Trade(0, 249); pl != 0 || inventory.Amount != 0 || inventory.Price != 0 {
+		t.Fatalf("Unexpected empty trade %v %+v", pl, inventory)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmm.pnl")
+	ledger, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2015, 10, 8, 12, 0, 0, 0, time.UTC)
+	fills := []bitfinex.Fill{
+		{ID: 1, Symbol: "btcusd", Timestamp: float64(day.Unix()), Amount: 2, Price: 250, Fee: -0.5, FeeCurrency: "USD"},
+		{ID: 2, Symbol: "btcusd", Timestamp: float64(day.Unix()), Amount: -1, Price: 252, Fee: -0.001, FeeCurrency: "BTC"},
+		{ID: 3, Symbol: "btcusd", Timestamp: float64(day.Add(24 * time.Hour).Unix()), Amount: -1, Price: 251, Fee: -0.25, FeeCurrency: "USD"},
+	}
+	for _, fill := range fills {
+		if err := ledger.Add(fill); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session := ledger.Session()
+	if session.Fills != 3 || session.Realized != 3 || session.Fees != 1.002 || session.Turnover != 1003 {
+		t.Fatalf("Unexpected session %+v", session)
+	}
+	if today := ledger.Day(day); today.Fills != 2 || today.Realized != 2 || today.Fees != 0.752 {
+		t.Fatalf("Unexpected day %+v", today)
+	}
+	if inventory := ledger.Inventory("btcusd"); inventory.Amount != 0 {
+		t.Fatalf("Unexpected inventory %+v", inventory)
+	}
+
+	// Restore inventory and days, not the session
+	ledger.Add(bitfinex.Fill{ID: 4, Symbol: "btcusd", Timestamp: float64(day.Unix()), Amount: 1, Price: 250})
+	restored, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventory := restored.Inventory("btcusd"); inventory.Amount != 1 || inventory.Price != 250 {
+		t.Fatalf("Unexpected restored inventory %+v", inventory)
+	}
+	if today := restored.Day(day); today.Fills != 3 {
+		t.Fatalf("Unexpected restored day %+v", today)
+	}
+	if session := restored.Session(); session.Fills != 0 {
+		t.Fatalf("Unexpected restored session %+v", session)
+	}
+
+	// Fills of no amount are ignored
+	restored.Add(bitfinex.Fill{ID: 5, Symbol: "ethusd", Timestamp: float64(day.Unix()), Price: 10, Fee: -0.1, FeeCurrency: "USD"})
+	if inventory := restored.Inventory("ethusd"); inventory.Amount != 0 || inventory.Price != 0 {
+		t.Fatalf("Unexpected empty fill inventory %+v", inventory)
+	}
+	if session := restored.Session(); session.Fills != 0 || session.Fees != 0 {
+		t.Fatalf("Unexpected empty fill session %+v", session)
+	}
+
+	// Restoring a state copies it
+	state := restored.State()
+	copied := Restore("", state)
+	state.Inventory["btcusd"].Amount = 5
+	if inventory := copied.Inventory("btcusd"); inventory.Amount != 1 {
+		t.Fatalf("Unexpected copied inventory %+v", inventory)
+	}
+}
+
+func TestReconciled(t *testing.T) {
+	ledger := New("")
+	now := float64(time.Date(2015, 10, 8, 12, 0, 0, 0, time.UTC).Unix())
+
+	// Found by reconciling before any of it was streamed
+	if err := ledger.Reconciled(bitfinex.Fill{OrderID: 7, Symbol: "btcusd", Timestamp: now, Amount: 3, Price: 250}); err != nil {
+		t.Fatal(err)
+	}
+	// Streamed later, only the amount beyond the 3 found counts, and every fee
+	streamed := []bitfinex.Fill{
+		{ID: 1, OrderID: 7, Symbol: "btcusd", Timestamp: now, Amount: 2, Price: 250, Fee: -0.5, FeeCurrency: "USD"},
+		{ID: 2, OrderID: 7, Symbol: "btcusd", Timestamp: now, Amount: 2, Price: 250, Fee: -0.5, FeeCurrency: "USD"},
+		{ID: 3, OrderID: 8, Symbol: "btcusd", Timestamp: now, Amount: -1, Price: 252},
+	}
+	for _, fill := range streamed {
+		if err := ledger.Add(fill); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if inventory := ledger.Inventory("btcusd"); inventory.Amount != 3 || inventory.Price != 250 {
+		t.Fatalf("Unexpected inventory %+v", inventory)
+	}
+	if session := ledger.Session(); session.Fills != 3 || session.Realized != 2 || session.Fees != 1 || session.Turnover != 1252 {
+		t.Fatalf("Unexpected session %+v", session)
+	}
+}
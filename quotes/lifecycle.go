@@ -0,0 +1,242 @@
+// Order lifecycle and reconciliation with the exchange
+
+package quotes
+
+import (
+	"bitmm/bitfinex"
+	"context"
+	"errors"
+	"math"
+)
+
+// State is where a managed order is in its lifecycle
+type State int
+
+const (
+	PendingNew      State = iota // Sent, not yet acknowledged by the exchange
+	Live                         // Resting on the exchange, nothing filled
+	PartiallyFilled              // Resting with some of its amount filled
+	Filled                       // Fully filled, no longer managed
+	Cancelled                    // Cancelled or replaced, no longer managed
+	Rejected                     // Never placed, no longer managed
+)
+
+// States each state can move to, terminal states none
+var transitions = map[State][]State{
+	PendingNew:      {Live, PartiallyFilled, Filled, Cancelled, Rejected},
+	Live:            {Live, PartiallyFilled, Filled, Cancelled},
+	PartiallyFilled: {PartiallyFilled, Filled, Cancelled},
+}
+
+// Execution is a fill of a managed order not received as a streamed fill
+type Execution struct {
+	OrderID int
+	Symbol  string
+	Side    string
+	Amount  float64 // Amount filled, positive
+	Price   float64 // Average price of the amount
+}
+
+// Report is what reconciling found
+type Report struct {
+	Executions  []Execution      // Fills seen in exchange responses, not streamed
+	Unknown     []bitfinex.Order // Live orders on the exchange the manager did not place
+	Unaccounted []Order          // Managed orders the exchange has no record of, no longer managed
+}
+
+// String returns the state's name
+func (s State) String() string {
+	switch s {
+	case PendingNew:
+		return "pending"
+	case Live:
+		return "live"
+	case PartiallyFilled:
+		return "partially filled"
+	case Filled:
+		return "filled"
+	case Cancelled:
+		return "cancelled"
+	case Rejected:
+		return "rejected"
+	}
+
+	return "unknown"
+}
+
+// Terminal reports whether an order in the state is done with
+func (s State) Terminal() bool {
+	return len(transitions[s]) == 0
+}
+
+// CanMove reports whether an order can move from the state to next
+func (s State) CanMove(next State) bool {
+	for _, t := range transitions[s] {
+		if t == next {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fill accounts for a streamed fill of a managed order, ignoring fills of
+// other orders and fills already found reconciling
+func (m *Manager) Fill(fill bitfinex.Fill) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, order := range m.orders {
+		if order.ID != fill.OrderID || order.ID == 0 {
+			continue
+		}
+		amount := math.Abs(fill.Amount)
+		order.streamed += amount
+		if found := order.streamed - order.Executed; found > epsilon {
+			m.execute(order, math.Min(found, amount), fill.Price)
+		}
+		if order.Remaining < epsilon {
+			m.move(order, Filled)
+		} else {
+			m.move(order, PartiallyFilled)
+		}
+		return
+	}
+}
+
+// Reconcile checks the managed orders against the exchange's live orders and
+// order statuses. It returns fills not streamed, including those of orders
+// that filled as they were placed, live orders the manager did not place,
+// and managed orders the exchange cannot account for.
+func (m *Manager) Reconcile(ctx context.Context) (Report, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := Report{Executions: m.executions}
+	m.executions = nil
+	active, err := m.client.ActiveOrdersContext(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	managed := make(map[int]bool)
+	for _, order := range m.orders {
+		managed[order.ID] = true
+	}
+	live := make(map[int]bitfinex.Order)
+	for _, order := range active {
+		live[order.ID] = order
+	}
+	claimed := make(map[int]bool)
+
+	for _, order := range append([]*Order(nil), m.orders...) {
+		// An unacknowledged order is found as a live order matching it, its
+		// price perhaps rounded by the exchange, or was never placed
+		if order.ID == 0 {
+			for _, o := range active {
+				p := order.Params
+				if !managed[o.ID] && !claimed[o.ID] && o.Symbol == p.Symbol && o.Side == p.Side &&
+					math.Abs(o.Price-p.Price) <= math.Max(m.Tolerance, epsilon) && math.Abs(o.OriginalAmount-p.Amount) < epsilon {
+					order.ID = o.ID
+					break
+				}
+			}
+			if order.ID == 0 {
+				m.move(order, Rejected)
+				continue
+			}
+		}
+
+		status, ok := live[order.ID]
+		if !ok {
+			status, err = m.client.OrderStatusContext(ctx, order.ID)
+			if errors.Is(err, bitfinex.ErrUnknownOrder) {
+				m.move(order, Cancelled)
+				report.Unaccounted = append(report.Unaccounted, *order)
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+		}
+		claimed[order.ID] = true
+		if execution, found := m.update(order, status); found {
+			report.Executions = append(report.Executions, execution)
+		}
+	}
+
+	for _, order := range active {
+		if !claimed[order.ID] {
+			report.Unknown = append(report.Unknown, order)
+		}
+	}
+
+	return report, nil
+}
+
+// update applies an order's status on the exchange, returning any fill it
+// shows that the manager had not seen
+func (m *Manager) update(order *Order, status bitfinex.Order) (execution Execution, found bool) {
+	if amount := status.ExecutedAmount - order.Executed; amount > epsilon {
+		// Price the new amount from the change in the average execution price
+		price := (status.ExecutionPrice*status.ExecutedAmount - order.AvgPrice*order.Executed) / amount
+		m.execute(order, amount, price)
+		execution = Execution{order.ID, order.Params.Symbol, order.Params.Side, amount, price}
+		found = true
+	}
+
+	switch {
+	case status.IsLive && order.Executed > epsilon:
+		m.move(order, PartiallyFilled)
+	case status.IsLive:
+		m.move(order, Live)
+	case status.IsCancelled:
+		m.move(order, Cancelled)
+	default:
+		m.move(order, Filled)
+	}
+
+	return execution, found
+}
+
+// resolve finds out how an order the exchange no longer has live ended,
+// assuming it was cancelled if the exchange cannot say
+func (m *Manager) resolve(ctx context.Context, order *Order) {
+	status, err := m.client.OrderStatusContext(ctx, order.ID)
+	if err != nil {
+		m.move(order, Cancelled)
+		return
+	}
+	if execution, found := m.update(order, status); found {
+		m.executions = append(m.executions, execution)
+	}
+	if !order.State.Terminal() {
+		// Still live after all, cancel everything before quoting again
+		m.unsure = true
+	}
+}
+
+// execute adds amount filled at price to an order
+func (m *Manager) execute(order *Order, amount, price float64) {
+	executed := order.Executed + amount
+	order.AvgPrice = (order.AvgPrice*order.Executed + price*amount) / executed
+	order.Executed = executed
+	order.Remaining = math.Max(0, order.Params.Amount-executed)
+}
+
+// move changes an order's state if the lifecycle allows it, no longer
+// managing it once in a terminal state
+func (m *Manager) move(order *Order, state State) {
+	if !order.State.CanMove(state) {
+		return
+	}
+	order.State = state
+	if state.Terminal() {
+		for i, o := range m.orders {
+			if o == order {
+				m.orders = append(m.orders[:i], m.orders[i+1:]...)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package quotes
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/paper"
+	"context"
+	"testing"
+)
+
+func TestStates(t *testing.T) {
+	for _, test := range []struct {
+		from, to State
+		ok       bool
+	}{
+		{PendingNew, Live, true},
+		{PendingNew, Rejected, true},
+		{Live, PartiallyFilled, true},
+		{PartiallyFilled, Live, false},
+		{Live, PendingNew, false},
+		{Filled, Cancelled, false},
+		{Rejected, Live, false},
+	} {
+		if test.from.CanMove(test.to) != test.ok {
+			t.Errorf("%s to %s: expected %v", test.from, test.to, test.ok)
+		}
+	}
+	if !Cancelled.Terminal() || PartiallyFilled.Terminal() {
+		t.Fatal("Unexpected terminal states")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	account := paper.New(market{}, 10000)
+	account.Match("btcusd", bitfinex.Trades{{TID: 1, Price: 250, Amount: 1}})
+	m := NewManager(account, 0.01)
+	if err := m.Update(ctx, []bitfinex.OrderParams{quote(10, 245, "buy"), quote(10, 255, "sell")}); err != nil {
+		t.Fatal(err)
+	}
+	buy, sell := m.Orders()[0], m.Orders()[1]
+
+	// Fills not streamed are found, the sell filled in full
+	account.Match("btcusd", bitfinex.Trades{{TID: 2, Price: 244, Amount: 4}, {TID: 3, Price: 256, Amount: 10}})
+	stranger, _ := account.NewOrderContext(ctx, "btcusd", 1, 260, "bitfinex", "sell", "limit")
+	report, err := m.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Executions) != 2 || report.Executions[0] != (Execution{buy.ID, "btcusd", "buy", 4, 245}) ||
+		report.Executions[1] != (Execution{sell.ID, "btcusd", "sell", 10, 255}) {
+		t.Fatalf("Unexpected executions %+v", report.Executions)
+	}
+	if len(report.Unknown) != 1 || report.Unknown[0].ID != stranger.ID || len(report.Unaccounted) != 0 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	orders := m.Orders()
+	if len(orders) != 1 || orders[0].State != PartiallyFilled || orders[0].Remaining != 6 || orders[0].AvgPrice != 245 {
+		t.Fatalf("Unexpected orders %+v", orders)
+	}
+
+	// The same fills streamed late are not counted again
+	for len(account.Fills) > 0 {
+		m.Fill(<-account.Fills)
+	}
+	if orders := m.Orders(); len(orders) != 1 || orders[0].Executed != 4 {
+		t.Fatalf("Expected fills counted once, got %+v", orders)
+	}
+
+	// An unacknowledged order is adopted if live, else rejected, and an order
+	// the exchange doesn't know is unaccounted for
+	adopted := m.pending(quote(1, 260, "sell"))
+	rejected := m.pending(quote(1, 261, "sell"))
+	m.orders = append(m.orders, &Order{ID: 999, Params: quote(1, 240, "buy"), Remaining: 1, State: Live})
+	report, err = m.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted.ID != stranger.ID || adopted.State != Live || rejected.State != Rejected {
+		t.Fatalf("Unexpected pending orders %+v %+v", adopted, rejected)
+	}
+	if len(report.Unknown) != 0 || len(report.Unaccounted) != 1 || report.Unaccounted[0].ID != 999 || len(report.Executions) != 0 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if orders := m.Orders(); len(orders) != 2 {
+		t.Fatalf("Unexpected orders %+v", orders)
+	}
+
+	// The exchange echoing a rounded price still matches
+	rounded, _ := account.NewOrderContext(ctx, "btcusd", 1, 262, "bitfinex", "sell", "limit")
+	pending := m.pending(quote(1, 262.004, "sell"))
+	if report, err = m.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending.ID != rounded.ID || pending.State != Live || len(report.Unknown) != 0 {
+		t.Fatalf("Expected rounded order matched, got %+v %+v", pending, report)
+	}
+}
@@ -0,0 +1,290 @@
+// Incremental management of our quotes on the exchange
+
+package quotes
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/exchange"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Tolerance for rounding when comparing amounts
+const epsilon = 1e-9
+
+// ErrNotCancelled is returned when the exchange does not confirm cancelling all orders
+var ErrNotCancelled = errors.New("quotes: orders not cancelled")
+
+// RejectedError is returned when the exchange definitely refused a new order,
+// leaving the other orders as the manager knows them
+type RejectedError struct {
+	Quote bitfinex.OrderParams // Quote the order was for
+	Err   error                // Error refusing it
+}
+
+// Order is an order placed by the manager
+type Order struct {
+	ID        int                  // Exchange order ID, 0 until acknowledged
+	Params    bitfinex.OrderParams // As placed, Amount is the original amount
+	Executed  float64              // Amount filled
+	AvgPrice  float64              // Average price of the amount filled
+	Remaining float64              // Amount still to be filled
+	State     State
+
+	streamed float64 // Amount filled according to streamed fills
+}
+
+// Manager keeps our orders on the exchange matching the quotes the strategy
+// wants, sending only the orders that changed. Safe for concurrent use.
+type Manager struct {
+	Tolerance float64 // Price change too small to replace an order for
+
+	mu         sync.Mutex
+	client     exchange.Trading
+	orders     []*Order    // Pending, live and partially filled orders, oldest first
+	unsure     bool        // A request failed, so orders may be live unknown to the manager
+	executions []Execution // Executions seen in order responses since reconciling
+}
+
+// NewManager returns a manager placing orders with client
+func NewManager(client exchange.Trading, tolerance float64) *Manager {
+	return &Manager{Tolerance: tolerance, client: client}
+}
+
+// Split divides quotes into those already live, which Update leaves alone,
+// and those Update would send
+func (m *Manager) Split(quotes []bitfinex.OrderParams) (live, changed []bitfinex.OrderParams) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept, _, _ := m.match(quotes)
+	for i, quote := range quotes {
+		if kept[i] != nil {
+			live = append(live, quote)
+		} else {
+			changed = append(changed, quote)
+		}
+	}
+
+	return live, changed
+}
+
+// Update makes our orders match quotes. Orders already matching a quote are
+// left alone, others are replaced by a quote on the same side or cancelled,
+// and quotes left over are placed as new orders. Orders filled or cancelled
+// behind the manager's back are placed afresh. It stops at the first error,
+// after which the next Update cancels all orders before placing any, unless
+// the exchange definitely rejected a new order.
+func (m *Manager) Update(ctx context.Context, quotes []bitfinex.OrderParams) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rejected := false
+	defer func() {
+		if err != nil && !rejected {
+			m.unsure = true
+		}
+	}()
+
+	if m.unsure {
+		if err := m.cancelAll(ctx); err != nil {
+			return err
+		}
+	}
+	kept, replaced, unpaired := m.match(quotes)
+
+	// Cancel first so the position can't exceed what the quotes allow
+	for _, order := range unpaired {
+		_, err := m.client.CancelOrderContext(ctx, order.ID)
+		switch {
+		case errors.Is(err, bitfinex.ErrUnknownOrder):
+			m.resolve(ctx, order)
+		case err != nil:
+			return err
+		default:
+			m.move(order, Cancelled)
+		}
+	}
+
+	for i, quote := range quotes {
+		if kept[i] != nil {
+			continue
+		}
+		if old := replaced[i]; old != nil {
+			order, err := m.client.ReplaceOrderContext(ctx, old.ID, quote.Symbol, quote.Amount, quote.Price, quote.Exchange, quote.Side, quote.Type)
+			if err != nil && !errors.Is(err, bitfinex.ErrUnknownOrder) {
+				return err
+			}
+			if err == nil {
+				m.move(old, Cancelled)
+				m.acknowledge(m.pending(quote), order)
+				continue
+			}
+			m.resolve(ctx, old)
+		}
+
+		// A new order stays pending until acknowledged, or until reconciling
+		// finds whether the exchange has it if the outcome is unknown
+		pending := m.pending(quote)
+		order, err := m.client.NewOrderContext(ctx, quote.Symbol, quote.Amount, quote.Price, quote.Exchange, quote.Side, quote.Type)
+		if errors.Is(err, bitfinex.ErrRejected) {
+			m.move(pending, Rejected)
+			rejected = true
+			return &RejectedError{quote, err}
+		}
+		if err != nil {
+			return err
+		}
+		m.acknowledge(pending, order)
+	}
+
+	return nil
+}
+
+// CancelAll cancels all our orders on the exchange, forgetting the managed
+// orders once confirmed
+func (m *Manager) CancelAll(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.cancelAll(ctx)
+}
+
+// Orders returns the managed orders, oldest first
+func (m *Manager) Orders() []Order {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	orders := make([]Order, len(m.orders))
+	for i, order := range m.orders {
+		orders[i] = *order
+	}
+
+	return orders
+}
+
+// Error describes the refused order
+func (err *RejectedError) Error() string {
+	q := err.Quote
+	return fmt.Sprintf("quotes: %s %v %s @ %v rejected: %s", q.Side, q.Amount, q.Symbol, q.Price, err.Err)
+}
+
+// Unwrap returns the error refusing the order
+func (err *RejectedError) Unwrap() error {
+	return err.Err
+}
+
+// match pairs quotes with managed orders. kept[i] is the order left alone for
+// quotes[i] and replaced[i] the order it replaces, both nil for a new order.
+// Orders paired with no quote are to be cancelled.
+func (m *Manager) match(quotes []bitfinex.OrderParams) (kept, replaced, unpaired []*Order) {
+	kept = make([]*Order, len(quotes))
+	replaced = make([]*Order, len(quotes))
+	paired := make(map[*Order]bool)
+
+	// Orders already as quoted, then any others on the same side
+	for i, quote := range quotes {
+		for _, order := range m.orders {
+			if !paired[order] && m.matches(order, quote) {
+				kept[i] = order
+				paired[order] = true
+				break
+			}
+		}
+	}
+	for i, quote := range quotes {
+		if kept[i] != nil {
+			continue
+		}
+		for _, order := range m.orders {
+			if !paired[order] && order.Params.Symbol == quote.Symbol && order.Params.Side == quote.Side {
+				replaced[i] = order
+				paired[order] = true
+				break
+			}
+		}
+	}
+	for _, order := range m.orders {
+		if !paired[order] {
+			unpaired = append(unpaired, order)
+		}
+	}
+
+	return kept, replaced, unpaired
+}
+
+// matches reports whether order is already as quoted, with the price within tolerance
+func (m *Manager) matches(order *Order, quote bitfinex.OrderParams) bool {
+	p := order.Params
+	return p.Symbol == quote.Symbol && p.Side == quote.Side && p.Type == quote.Type &&
+		math.Abs(p.Price-quote.Price) <= math.Max(m.Tolerance, epsilon) &&
+		math.Abs(order.Remaining-quote.Amount) < epsilon
+}
+
+// Adopt manages live orders placed outside the manager, e.g. by an earlier
+// session, so Update keeps, replaces or cancels them like its own
+func (m *Manager) Adopt(orders []bitfinex.Order) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, o := range orders {
+		order := &Order{
+			ID:        o.ID,
+			Params:    bitfinex.OrderParams{o.Symbol, o.OriginalAmount, o.Price, o.Exchange, o.Side, o.Type},
+			Remaining: o.OriginalAmount,
+			State:     PendingNew,
+		}
+		m.orders = append(m.orders, order)
+		m.update(order, o)
+	}
+}
+
+// Live reports whether any orders may be live, including any the manager
+// lost track of
+func (m *Manager) Live() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.orders) > 0 || m.unsure
+}
+
+// pending starts managing a new order for quote
+func (m *Manager) pending(quote bitfinex.OrderParams) *Order {
+	order := &Order{Params: quote, Remaining: quote.Amount, State: PendingNew}
+	m.orders = append(m.orders, order)
+
+	return order
+}
+
+// acknowledge updates a pending order from the exchange's response placing it
+func (m *Manager) acknowledge(order *Order, placed bitfinex.Order) {
+	order.ID = placed.ID
+	if placed.RemainingAmount == 0 && placed.ExecutedAmount == 0 {
+		// Not every response reports the amounts
+		placed.RemainingAmount = order.Params.Amount
+		placed.IsLive = true
+	}
+	if execution, ok := m.update(order, placed); ok {
+		m.executions = append(m.executions, execution)
+	}
+}
+
+// cancelAll cancels all orders, marking the manager unsure unless confirmed
+func (m *Manager) cancelAll(ctx context.Context) error {
+	cancelled, err := m.client.CancelAllContext(ctx)
+	if err == nil && !cancelled {
+		err = ErrNotCancelled
+	}
+	if err != nil {
+		m.unsure = true
+		return err
+	}
+	for _, order := range m.orders {
+		order.State = Cancelled
+	}
+	m.orders, m.unsure = nil, false
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package quotes
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/paper"
+	"context"
+	"errors"
+	"testing"
+)
+
+// market has no data, trades are matched directly
+type market struct{}
+
+func (market) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	return bitfinex.Trades{}, nil
+}
+
+func (market) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	return bitfinex.Book{}, nil
+}
+
+func quote(amount, price float64, side string) bitfinex.OrderParams {
+	return bitfinex.OrderParams{"btcusd", amount, price, "bitfinex", side, "limit"}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	account := paper.New(market{}, 10000)
+	account.Match("btcusd", bitfinex.Trades{{TID: 1, Price: 250, Amount: 1}})
+	m := NewManager(account, 0.01)
+
+	if err := m.Update(ctx, []bitfinex.OrderParams{quote(10, 245, "buy"), quote(10, 255, "sell")}); err != nil {
+		t.Fatal(err)
+	}
+	first := m.Orders()
+	if len(first) != 2 || first[0].State != Live {
+		t.Fatalf("Unexpected orders %+v", first)
+	}
+
+	// Only the sell moved more than the tolerance
+	quotes := []bitfinex.OrderParams{quote(10, 245.005, "buy"), quote(10, 256, "sell")}
+	if live, changed := m.Split(quotes); len(live) != 1 || len(changed) != 1 || changed[0].Side != "sell" {
+		t.Fatalf("Unexpected split %+v %+v", live, changed)
+	}
+	if err := m.Update(ctx, quotes); err != nil {
+		t.Fatal(err)
+	}
+	orders := m.Orders()
+	if len(orders) != 2 || orders[0].ID != first[0].ID || orders[1].ID == first[1].ID || orders[1].Params.Price != 256 {
+		t.Fatalf("Expected sell replaced, got %+v", orders)
+	}
+
+	// A partially filled buy is kept when the quote is for what remains
+	account.Match("btcusd", bitfinex.Trades{{TID: 2, Price: 244, Amount: 3}})
+	m.Fill(<-account.Fills)
+	if orders := m.Orders(); orders[0].State != PartiallyFilled || orders[0].Remaining != 7 {
+		t.Fatalf("Expected partial fill, got %+v", orders[0])
+	}
+	if err := m.Update(ctx, []bitfinex.OrderParams{quote(7, 245, "buy")}); err != nil {
+		t.Fatal(err)
+	}
+	orders = m.Orders()
+	if len(orders) != 1 || orders[0].ID != first[0].ID {
+		t.Fatalf("Expected buy kept and sell cancelled, got %+v", orders)
+	}
+	if active, _ := account.ActiveOrdersContext(ctx); len(active) != 1 {
+		t.Fatalf("Unexpected active orders %+v", active)
+	}
+
+	// An order filled unseen is placed afresh
+	account.Match("btcusd", bitfinex.Trades{{TID: 3, Price: 244, Amount: 7}})
+	if err := m.Update(ctx, []bitfinex.OrderParams{quote(5, 246, "buy")}); err != nil {
+		t.Fatal(err)
+	}
+	active, _ := account.ActiveOrdersContext(ctx)
+	if orders := m.Orders(); len(orders) != 1 || len(active) != 1 || active[0].ID != orders[0].ID || active[0].RemainingAmount != 5 {
+		t.Fatalf("Unexpected orders %+v, active %+v", orders, active)
+	}
+
+	// A rejected order isn't left pending, and the orders placed stay known
+	err := m.Update(ctx, []bitfinex.OrderParams{quote(5, 246, "buy"), quote(5, -1, "sell")})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || !errors.Is(err, bitfinex.ErrRejected) || rejected.Quote.Side != "sell" {
+		t.Fatalf("Expected rejection, got %v", err)
+	}
+	if orders := m.Orders(); len(orders) != 1 || orders[0].ID != active[0].ID {
+		t.Fatalf("Expected rejected order dropped, got %+v", orders)
+	}
+	if err := m.Update(ctx, []bitfinex.OrderParams{quote(5, 246, "buy")}); err != nil || m.Orders()[0].ID != active[0].ID {
+		t.Fatalf("Expected buy kept without cancelling all, got %v %+v", err, m.Orders())
+	}
+
+	if err := m.CancelAll(ctx); err != nil || len(m.Orders()) != 0 {
+		t.Fatalf("Expected all cancelled, got %v %+v", err, m.Orders())
+	}
+	if active, _ := account.ActiveOrdersContext(ctx); len(active) != 0 {
+		t.Fatalf("Unexpected active orders %+v", active)
+	}
+}
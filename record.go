@@ -0,0 +1,77 @@
+// Record market data for backtesting and latency analysis
+
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/recorder"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Book levels recorded for each symbol
+const recordBookLength = 25
+
+// Record trades, books and tickers for the configured symbols until input is received
+func runRecord() error {
+	symbols := recordSymbols()
+	if err := os.MkdirAll(cfg.Sec.RecordDir, 0777); err != nil {
+		return err
+	}
+
+	stream := bitfinex.NewStream("")
+	for _, symbol := range symbols {
+		stream.SubscribeTrades(symbol)
+		stream.SubscribeTicker(symbol)
+		stream.SubscribeBook(symbol, recordBookLength)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.Run(ctx)
+	go logErrors(stream.Errors, "Websocket")
+
+	writer := recorder.NewWriter(cfg.Sec.RecordDir, "bitfinex", time.Duration(cfg.Sec.RecordRotate)*time.Minute)
+	defer writer.Close()
+
+	inputChan := make(chan string)
+	go checkStdin(inputChan)
+	notifySignals(inputChan, make(chan os.Signal, 1))
+	fmt.Printf("\nRecording %s to %s, press enter to stop...\n", strings.Join(symbols, ", "), cfg.Sec.RecordDir)
+
+	for {
+		var records []recorder.Record
+		select {
+		case <-inputChan:
+			return writer.Close()
+		case e := <-stream.Trades:
+			records = recorder.TradeRecords(e, time.Now())
+		case e := <-stream.Books:
+			records = []recorder.Record{recorder.BookRecord(e, time.Now())}
+		case e := <-stream.Tickers:
+			records = []recorder.Record{recorder.TickerRecord(e, time.Now())}
+		}
+		for _, record := range records {
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Symbols to record, the trading symbol if none are configured
+func recordSymbols() []string {
+	var symbols []string
+	for _, symbol := range strings.Split(cfg.Sec.RecordSymbols, ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			symbols = append(symbols, symbol)
+		}
+	}
+	if len(symbols) == 0 {
+		symbols = []string{cfg.Sec.Symbol}
+	}
+
+	return symbols
+}
@@ -0,0 +1,210 @@
+// Recorded market data files
+//
+// Market data is recorded as newline-delimited JSON, one Record per line,
+// gzip compressed. A new file, named prefix-YYYYMMDDTHHMMSSZ.jsonl.gz after
+// the UTC start of its period, is started every rotation interval. Files may
+// hold several gzip members and may end with an incomplete member if the
+// recorder was killed; Read accepts both.
+
+package recorder
+
+import (
+	"bitmm/bitfinex"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Record types
+const (
+	TypeTrade  = "trade"
+	TypeBook   = "book"
+	TypeTicker = "ticker"
+)
+
+// Record is one line of a recorded file. Exactly one of Trade, Book and
+// Ticker is set, matching Type.
+type Record struct {
+	Type     string                `json:"type"`               // TypeTrade, TypeBook or TypeTicker
+	Symbol   string                `json:"symbol"`             // Symbol, e.g. "btcusd"
+	Exchange float64               `json:"exchange_time"`      // Exchange time in seconds, 0 if unknown
+	Received float64               `json:"received_time"`      // Local receive time in seconds
+	Snapshot bool                  `json:"snapshot,omitempty"` // True for trades sent on subscribing, not traded live
+	Trade    *bitfinex.Trade       `json:"trade,omitempty"`    // A single trade
+	Book     *bitfinex.BookEvent   `json:"book,omitempty"`     // Book snapshot, update or checksum
+	Ticker   *bitfinex.TickerEvent `json:"ticker,omitempty"`   // Ticker
+}
+
+// Writer writes records to compressed files in a directory, rotating files
+// every Interval. It is not safe for concurrent use.
+type Writer struct {
+	Dir      string        // Directory for files
+	Prefix   string        // File name prefix, e.g. "bitfinex"
+	Interval time.Duration // Time covered by each file, one file if 0
+
+	now    func() time.Time
+	start  time.Time // Start of the period of the current file
+	file   *os.File
+	gz     *gzip.Writer
+	writer *json.Encoder
+}
+
+// NewWriter returns a writer creating files in dir
+func NewWriter(dir, prefix string, interval time.Duration) *Writer {
+	return &Writer{Dir: dir, Prefix: prefix, Interval: interval, now: time.Now}
+}
+
+// Write appends a record, flushed so it survives the recorder being killed
+func (w *Writer) Write(r Record) error {
+	if err := w.rotate(); err != nil {
+		return err
+	}
+	if err := w.writer.Encode(r); err != nil {
+		return err
+	}
+
+	return w.gz.Flush()
+}
+
+// Close completes and closes the current file
+func (w *Writer) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+
+	return err
+}
+
+// rotate opens the file for the current period, appending if it exists
+func (w *Writer) rotate() error {
+	start := w.now().UTC()
+	if w.Interval > 0 {
+		start = start.Truncate(w.Interval)
+	} else if w.file != nil {
+		start = w.start
+	}
+	if w.file != nil && start.Equal(w.start) {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(w.Dir, fmt.Sprintf("%s-%s.jsonl.gz", w.Prefix, start.Format("20060102T150405Z")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.file, w.start = file, start
+	w.gz = gzip.NewWriter(file)
+	w.writer = json.NewEncoder(w.gz)
+
+	return nil
+}
+
+// Open opens a recorded file, decompressing it if it is gzipped
+func Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	magic, _ := buffered.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return readCloser{buffered, file}, nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return readCloser{gz, file}, nil
+}
+
+// Read calls fn with each record in r, stopping at the first error. An
+// incomplete final line or gzip member, left by a killed recorder, ends the
+// data without error. A line holding a bare trade, as returned by the trades
+// API, is read as a trade record.
+func Read(r io.Reader, fn func(Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	bad := 0 // Line of an unreadable record, an error unless it is the last
+	for line := 1; scanner.Scan(); line++ {
+		if bad != 0 {
+			return fmt.Errorf("recorder: line %d: bad record", bad)
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			bad = line
+			continue
+		}
+		if record.Trade == nil && record.Book == nil && record.Ticker == nil {
+			var trade bitfinex.Trade
+			if err := json.Unmarshal(scanner.Bytes(), &trade); err != nil {
+				bad = line
+				continue
+			}
+			record = Record{Type: TypeTrade, Trade: &trade}
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	return nil
+}
+
+// TradeRecords converts a trade event received at received to records, oldest first
+func TradeRecords(e bitfinex.TradeEvent, received time.Time) []Record {
+	records := make([]Record, 0, len(e.Trades))
+	for i := len(e.Trades) - 1; i >= 0; i-- {
+		trade := e.Trades[i]
+		records = append(records, Record{TypeTrade, e.Symbol, e.Timestamp, seconds(received), e.Snapshot, &trade, nil, nil})
+	}
+
+	return records
+}
+
+// BookRecord converts a book event received at received to a record
+func BookRecord(e bitfinex.BookEvent, received time.Time) Record {
+	return Record{TypeBook, e.Symbol, e.Timestamp, seconds(received), false, nil, &e, nil}
+}
+
+// TickerRecord converts a ticker event received at received to a record
+func TickerRecord(e bitfinex.TickerEvent, received time.Time) Record {
+	return Record{TypeTicker, e.Symbol, e.Timestamp, seconds(received), false, nil, nil, &e}
+}
+
+// seconds converts a time to fractional Unix seconds
+func seconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// readCloser reads from a decompressing reader and closes the file
+type readCloser struct {
+	io.Reader
+	file *os.File
+}
+
+// Close closes the file
+func (rc readCloser) Close() error {
+	return rc.file.Close()
+}
@@ -0,0 +1,106 @@
+package recorder
+
+import (
+	"bitmm/bitfinex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2015, 10, 8, 1, 59, 0, 0, time.UTC)
+	w := NewWriter(dir, "bitfinex", time.Hour)
+	w.now = func() time.Time { return now }
+
+	trades := bitfinex.TradeEvent{Symbol: "btcusd", Snapshot: true, Timestamp: 1444269540.5, Trades: bitfinex.Trades{
+		{TID: 2, Price: 251, Amount: 1, Type: "buy"},
+		{TID: 1, Price: 250, Amount: 2, Type: "sell"},
+	}}
+	for _, record := range TradeRecords(trades, now) {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	book := bitfinex.BookEvent{Symbol: "btcusd", Levels: []bitfinex.BookLevel{{Price: 250, Count: 1, Amount: -1}}}
+	if err := w.Write(BookRecord(book, now)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening a period appends to its file
+	now = now.Add(time.Minute)
+	if err := w.Write(TickerRecord(bitfinex.TickerEvent{Symbol: "btcusd", Bid: 250}, now)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 || filepath.Base(files[0]) != "bitfinex-20151008T010000Z.jsonl.gz" ||
+		filepath.Base(files[1]) != "bitfinex-20151008T020000Z.jsonl.gz" {
+		t.Fatalf("Unexpected files %v", files)
+	}
+
+	records := read(t, files[0])
+	if len(records) != 2 || records[0].Trade.TID != 1 || !records[0].Snapshot || records[1].Type != TypeTrade {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+	if records[0].Exchange != 1444269540.5 || records[0].Received != 1444269540 {
+		t.Fatalf("Unexpected times %+v", records[0])
+	}
+	records = read(t, files[1])
+	if len(records) != 2 || records[0].Book.Levels[0].Amount != -1 || records[1].Ticker.Bid != 250 {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	dir := t.TempDir()
+	w := NewWriter(dir, "bitfinex", 0)
+	for i := 0; i < 3; i++ {
+		w.Write(TickerRecord(bitfinex.TickerEvent{Symbol: "btcusd", Bid: float64(i)}, time.Now()))
+	}
+	w.Close()
+
+	// A killed recorder leaves a file without the gzip trailer
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	data, _ := os.ReadFile(files[0])
+	os.WriteFile(files[0], data[:len(data)-8], 0666)
+	if records := read(t, files[0]); len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+
+	// Only a bad final line is ignored
+	err := Read(strings.NewReader(`{"type":"ticker"}`+"\n{\n"), func(Record) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Read(strings.NewReader("{\n"+`{"type":"ticker"}`+"\n"), func(Record) error { return nil })
+	if err == nil {
+		t.Fatal("Expected error for bad line")
+	}
+}
+
+func read(t *testing.T, path string) []Record {
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []Record
+	err = Read(f, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
@@ -0,0 +1,87 @@
+// Recover orders and position left by an earlier session before quoting
+
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/pnl"
+	"fmt"
+	"log"
+	"math"
+)
+
+// Policies for orders found live at startup
+const (
+	orphansCancel = "cancel" // Cancel them all
+	orphansAdopt  = "adopt"  // Manage those for the symbol as our own
+)
+
+// Account for orders and position left by an earlier session: cancel or adopt
+// live orders per the orphans policy and bring the ledger's inventory in line
+// with the exchange's position. Quoting must wait until this succeeds.
+func recoverSession() error {
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	orders, err := client.ActiveOrdersContext(ctx)
+	if err != nil {
+		return fmt.Errorf("active orders: %s", err)
+	}
+	switch cfg.Sec.Orphans {
+	case orphansCancel:
+		if len(orders) == 0 {
+			break
+		}
+		if err := quoter.CancelAll(ctx); err != nil {
+			return err
+		}
+		// Only trust the cancel once the exchange shows no live orders
+		orders, err = client.ActiveOrdersContext(ctx)
+		if err != nil {
+			return fmt.Errorf("active orders: %s", err)
+		}
+		if len(orders) > 0 {
+			return fmt.Errorf("%d orders still live after cancelling", len(orders))
+		}
+		log.Println("Recovery: cancelled orders left live")
+	case orphansAdopt:
+		var adopted []bitfinex.Order
+		for _, order := range orders {
+			if order.Symbol == cfg.Sec.Symbol {
+				adopted = append(adopted, order)
+			} else {
+				log.Printf("Recovery: leaving order %d for %s\n", order.ID, order.Symbol)
+			}
+		}
+		quoter.Adopt(adopted)
+		log.Printf("Recovery: adopted %d orders left live\n", len(adopted))
+	default:
+		return fmt.Errorf("unknown orphans policy %q", cfg.Sec.Orphans)
+	}
+
+	positions, err := client.ActivePositionsContext(ctx)
+	if err != nil {
+		return fmt.Errorf("active positions: %s", err)
+	}
+	var position bitfinex.Position
+	for _, p := range positions {
+		if p.Symbol == cfg.Sec.Symbol {
+			position = p
+		}
+	}
+
+	// The exchange's position is right, keep the ledger's entry price if it agrees
+	if ledger != nil {
+		inventory := ledger.Inventory(cfg.Sec.Symbol)
+		if math.Abs(inventory.Amount-position.Amount) > 1e-8 {
+			log.Printf("Recovery: ledger inventory %.4f @ %.4f, exchange position %.4f @ %.4f, using the exchange's\n",
+				inventory.Amount, inventory.Price, position.Amount, position.Base)
+			err := ledger.SetInventory(cfg.Sec.Symbol, pnl.Inventory{Amount: position.Amount, Price: position.Base})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/paper"
+	"bitmm/pnl"
+	"bitmm/quotes"
+	"context"
+	"testing"
+	"time"
+
+	"code.google.com/p/gcfg"
+)
+
+// Set up a paper account left long 2 with a buy and a sell live, and a
+// ledger that missed the last fill
+func crashedSession(t *testing.T, orphans string) *paper.Account {
+	err := gcfg.ReadFileInto(&cfg, "bitmm.gcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sec.Orphans = orphans
+
+	ctx := context.Background()
+	a := paper.New(&replay{}, 10000)
+	a.Match(cfg.Sec.Symbol, bitfinex.Trades{{TID: 1, Price: 250, Amount: 1}})
+	a.NewOrderContext(ctx, cfg.Sec.Symbol, 2, 0, "bitfinex", "buy", "market")
+	a.NewOrderContext(ctx, cfg.Sec.Symbol, 1, 240, "bitfinex", "buy", "limit")
+	a.NewOrderContext(ctx, cfg.Sec.Symbol, 1, 260, "bitfinex", "sell", "limit")
+
+	resetLoop(a)
+	ledger = pnl.Restore("", pnl.State{Inventory: map[string]*pnl.Inventory{cfg.Sec.Symbol: {Amount: 1, Price: 249}}})
+
+	return a
+}
+
+func TestRecoverCancel(t *testing.T) {
+	a := crashedSession(t, orphansCancel)
+	if err := recoverSession(); err != nil {
+		t.Fatal(err)
+	}
+	if orders, _ := a.ActiveOrdersContext(context.Background()); len(orders) != 0 {
+		t.Fatalf("Expected orders cancelled, got %+v", orders)
+	}
+	if inventory := ledger.Inventory(cfg.Sec.Symbol); inventory.Amount != 2 || inventory.Price != 250 {
+		t.Fatalf("Expected inventory from the exchange, got %+v", inventory)
+	}
+	if quoter.Live() {
+		t.Fatal("Expected no orders live")
+	}
+}
+
+func TestRecoverAdopt(t *testing.T) {
+	a := crashedSession(t, orphansAdopt)
+	if err := recoverSession(); err != nil {
+		t.Fatal(err)
+	}
+	orders := quoter.Orders()
+	if len(orders) != 2 || orders[0].State != quotes.Live || orders[1].Params.Side != "sell" || orders[1].Remaining != 1 {
+		t.Fatalf("Expected orders adopted, got %+v", orders)
+	}
+
+	// Adopted orders are replaced or cancelled like our own
+	err := quoter.Update(context.Background(), []bitfinex.OrderParams{{cfg.Sec.Symbol, 1, 241, "bitfinex", "buy", "limit"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := a.ActiveOrdersContext(context.Background()); len(active) != 1 || active[0].Price != 241 {
+		t.Fatalf("Unexpected active orders %+v", active)
+	}
+
+	cfg.Sec.Orphans = "ignore"
+	if err := recoverSession(); err == nil {
+		t.Fatal("Expected error for unknown policy")
+	}
+}
+
+// counted is an account whose orders can't be cancelled, counting attempts
+type counted struct {
+	stuck
+	attempts *int
+}
+
+func (c counted) CancelAllContext(ctx context.Context) (bool, error) {
+	*c.attempts++
+	return c.stuck.CancelAllContext(ctx)
+}
+
+func TestRecoverRetry(t *testing.T) {
+	a := crashedSession(t, orphansCancel)
+	cfg.Sec.RetryDelay = 0.5
+	if recoveryDelay(0) != 500*time.Millisecond || recoveryDelay(1) != time.Second || recoveryDelay(20) != time.Minute {
+		t.Fatalf("Unexpected delays %v %v %v", recoveryDelay(0), recoveryDelay(1), recoveryDelay(20))
+	}
+
+	// Failed recovery waits before retrying instead of spinning
+	var attempts int
+	killSwitch = nil
+	setupLoop(counted{stuck{a}, &attempts})
+	inputChan := make(chan string)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		inputChan <- "quit"
+	}()
+	runMainLoop(inputChan, nil, nil)
+	if attempts != 2 {
+		t.Fatalf("Expected one recovery attempt before quitting, got %d cancels", attempts)
+	}
+}
@@ -0,0 +1,192 @@
+// Replay a journaled session through the main loop
+
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/journal"
+	"bitmm/pnl"
+	"bitmm/risk"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// replayClock returns journaled times and, when the main loop reads the clock
+// before checking its channels, makes ready the channel it read from when
+// journaled so the loop takes the same path
+type replayClock struct {
+	journal *journal.Reader
+	input   chan string
+	trades  chan bitfinex.TradeEvent
+	fills   chan bitfinex.Fill
+	sent    int // Sequence number of the last input sent, -1 at the end
+}
+
+// Replay the journal at path, reporting where the loop's inputs diverge from it
+func runReplay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader, err := journal.NewReader(f)
+	if err != nil {
+		return err
+	}
+	if err := replayJournal(reader); err != nil {
+		return err
+	}
+
+	consumed, total := reader.Position()
+	switch err := reader.Err(); err {
+	case nil:
+		fmt.Printf("\nReplayed all %d journal entries, no divergence.\n", total)
+	case journal.ErrEnd:
+		fmt.Printf("\nReplayed all %d journal entries, the session ended without exiting.\n", total)
+	default:
+		fmt.Printf("\nDiverged after %d of %d journal entries: %s\n", consumed, total, err)
+	}
+
+	return nil
+}
+
+// Run the main loop on the journaled settings and inputs until they run out
+// or diverge
+func replayJournal(reader *journal.Reader) error {
+	if err := reader.Next("Config", nil, &cfg.Sec); err != nil {
+		return err
+	}
+	var state pnl.State
+	if err := reader.Next("Ledger", nil, &state); err != nil {
+		return err
+	}
+	// Journals from before paper fills were taken when polling have no entry
+	var paperMode bool
+	if entry, ok := reader.Peek(); ok && entry.Kind == "Paper" {
+		if err := reader.Next("Paper", nil, &paperMode); err != nil {
+			return err
+		}
+	}
+	var err error
+	ledger = pnl.Restore("", state)
+	if killSwitch, err = risk.NewKillSwitch(lossLimits(), ""); err != nil {
+		return err
+	}
+	preTrade = risk.NewPreTrade(orderLimits())
+
+	// Fills has room for every entry, as a paper session polling is sent all
+	// the fills journaled after fetching trades before taking any
+	_, total := reader.Position()
+	c := &replayClock{
+		journal: reader,
+		input:   make(chan string, 1),
+		trades:  make(chan bitfinex.TradeEvent, 1),
+		fills:   make(chan bitfinex.Fill, total),
+	}
+	client, clock, events, books, account = journal.NewPlayer(reader), c, reader, nil, nil
+
+	// Streamed trades and fills are only waited for with the websocket, paper
+	// fills are taken after fetching trades without it
+	var (
+		tradeChan <-chan bitfinex.TradeEvent
+		fillChan  <-chan bitfinex.Fill
+	)
+	if cfg.Sec.Websocket {
+		tradeChan, fillChan = c.trades, c.fills
+	} else if paperMode {
+		client, fillChan = replayMarket{journal.NewPlayer(reader), reader, c.fills}, c.fills
+	}
+	resetLoop(client)
+	runMainLoop(c.input, tradeChan, fillChan)
+
+	return nil
+}
+
+// Now returns the journaled time. The loop checks for input next, so a
+// journaled input is sent now.
+func (c *replayClock) Now() time.Time {
+	var now time.Time
+	c.journal.Next("Now", nil, &now)
+	if entry, ok := c.journal.Peek(); !ok {
+		c.sendInput(-1, "quit")
+	} else if entry.Kind == "Input" {
+		c.sendInput(entry.Seq, inputLine(entry))
+	}
+
+	return now
+}
+
+// After is called as the loop waits for streamed trades, fills, input or the
+// poll interval, and makes ready whichever it journaled next
+func (c *replayClock) After(d time.Duration) <-chan time.Time {
+	elapsed := make(chan time.Time, 1)
+	entry, ok := c.journal.Peek()
+	if !ok {
+		c.sendInput(-1, "quit")
+		return elapsed
+	}
+
+	switch entry.Kind {
+	case "Input":
+		c.sendInput(entry.Seq, inputLine(entry))
+	case "Trade":
+		c.trades <- bitfinex.TradeEvent{Symbol: cfg.Sec.Symbol}
+	case "Fill":
+		var fill bitfinex.Fill
+		json.Unmarshal(entry.Result, &fill)
+		c.fills <- fill
+	case "Poll":
+		elapsed <- time.Time{}
+	default:
+		// The loop is waiting where the journal has it doing something else
+		c.journal.Next("Wait", nil, nil)
+		c.sendInput(-1, "quit")
+	}
+
+	return elapsed
+}
+
+// sendInput sends line once for the journal entry seq, -1 to stop at the end
+func (c *replayClock) sendInput(seq int, line string) {
+	if c.sent == seq {
+		return
+	}
+	c.sent = seq
+	select {
+	case c.input <- line:
+	default:
+	}
+}
+
+// inputLine returns the command journaled in an input entry, quit for
+// journals from before commands
+func inputLine(entry journal.Entry) string {
+	line := "quit"
+	json.Unmarshal(entry.Result, &line)
+
+	return line
+}
+
+// replayMarket is the journaled exchange of a paper session polling for
+// trades, making ready the fills journaled as taken after fetching them
+type replayMarket struct {
+	journal.Player
+	journal *journal.Reader
+	fills   chan bitfinex.Fill
+}
+
+// TradesContext returns the journaled trades and sends the fills following them
+func (m replayMarket) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	trades, err := m.Player.TradesContext(ctx, symbol, limitTrades)
+	for _, entry := range m.journal.Following("Fill") {
+		var fill bitfinex.Fill
+		json.Unmarshal(entry.Result, &fill)
+		m.fills <- fill
+	}
+
+	return trades, err
+}
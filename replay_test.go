@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/journal"
+	"bitmm/paper"
+	"bitmm/pnl"
+	"bitmm/risk"
+	"bytes"
+	"code.google.com/p/gcfg"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+// steppingMarket releases one more trade on each call and sends input after
+// the last one
+type steppingMarket struct {
+	trades bitfinex.Trades // Oldest first
+	n      int
+	input  chan string
+}
+
+func (m *steppingMarket) TradesContext(ctx context.Context, symbol string, limitTrades int) (bitfinex.Trades, error) {
+	if m.n < len(m.trades) {
+		m.n++
+	}
+	if m.n == len(m.trades) {
+		m.input <- "quit"
+	}
+	r := replay{trades: m.trades, n: m.n}
+
+	return r.TradesContext(ctx, symbol, limitTrades)
+}
+
+func (m *steppingMarket) OrderbookContext(ctx context.Context, symbol string, limitBids, limitAsks int) (bitfinex.Book, error) {
+	return bitfinex.Book{}, nil
+}
+
+// Journal a polling session on a paper account
+func journalSession(t *testing.T) *bytes.Buffer {
+	err := gcfg.ReadFileInto(&cfg, "bitmm.gcfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Sec.Websocket, cfg.Sec.Reconcile = false, 0
+
+	market := &steppingMarket{input: make(chan string, 1)}
+	for i := 0; i < 120; i++ {
+		market.trades = append(market.trades, bitfinex.Trade{
+			Timestamp: 60 * i,
+			TID:       i + 1,
+			Price:     250 + 5*math.Sin(float64(i)/10),
+			Amount:    1,
+		})
+	}
+	market.n = 60
+
+	var buf bytes.Buffer
+	w := journal.NewWriter(&buf)
+	w.Record("Config", nil, cfg.Sec, nil)
+	ledger, killSwitch, preTrade = pnl.New(""), nil, risk.NewPreTrade(orderLimits())
+	w.Record("Ledger", nil, ledger.State(), nil)
+	w.Record("Paper", nil, true, nil)
+	a := paper.New(market, 1000)
+	clock, events = journal.NewClock(journal.System{}, w), w
+	resetLoop(journal.NewClient(a, w))
+	runMainLoop(market.input, nil, a.Fills)
+	events = nil
+
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestReplay(t *testing.T) {
+	buf := journalSession(t)
+	if !strings.Contains(buf.String(), `"kind":"NewOrder"`) {
+		t.Fatal("Expected orders in journal")
+	}
+
+	// Paper fills are accounted when polling, without reconciling
+	if fills := ledger.Session().Fills; fills == 0 || !strings.Contains(buf.String(), `"kind":"Fill"`) {
+		t.Fatalf("Expected paper fills accounted and journaled, got %d", fills)
+	}
+
+	reader, err := journal.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replayJournal(reader); err != nil {
+		t.Fatal(err)
+	}
+	if consumed, total := reader.Position(); reader.Err() != nil || consumed != total {
+		t.Fatalf("Replay stopped at %d of %d: %v", consumed, total, reader.Err())
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	buf := journalSession(t)
+
+	// Replay with a wider edge than was journaled, within the price collar
+	lines := strings.SplitN(buf.String(), "\n", 2)
+	var entry journal.Entry
+	json.Unmarshal([]byte(lines[0]), &entry)
+	var sec map[string]interface{}
+	json.Unmarshal(entry.Result, &sec)
+	sec["MinEdge"] = 5
+	entry.Result, _ = json.Marshal(sec)
+	first, _ := json.Marshal(entry)
+
+	reader, err := journal.NewReader(strings.NewReader(string(first) + "\n" + lines[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replayJournal(reader); err != nil {
+		t.Fatal(err)
+	}
+	var divergence *journal.DivergenceError
+	if !errors.As(reader.Err(), &divergence) || divergence.Kind != "NewOrder" {
+		t.Fatalf("Expected divergence on orders, got %v", reader.Err())
+	}
+}
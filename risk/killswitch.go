@@ -0,0 +1,135 @@
+// Loss limits stopping the strategy
+
+package risk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrTripped is matched by the errors of a tripped kill switch
+var ErrTripped = errors.New("risk: kill switch tripped")
+
+// LossLimits are the losses at which trading stops, each unlimited if 0
+type LossLimits struct {
+	Daily    float64 // Loss over the UTC day
+	Session  float64 // Loss since the strategy started
+	Drawdown float64 // Fall in session P&L from its highest point
+}
+
+// TripError reports why the kill switch tripped
+type TripError struct {
+	Time   time.Time `json:"time"`   // When the limit was breached
+	Reason string    `json:"reason"` // Limit breached and the P&L breaching it
+}
+
+// KillSwitch trips when P&L breaches a loss limit and stays tripped, across
+// restarts if it has a latch file, until Reset. Safe for concurrent use.
+type KillSwitch struct {
+	Limits LossLimits
+
+	mu      sync.Mutex
+	path    string     // Latch file, none if empty
+	peak    float64    // Highest session P&L
+	tripped *TripError // Why the switch tripped, nil if not
+}
+
+// NewKillSwitch returns a kill switch latched in the file at path, none if
+// empty, tripped if the file exists
+func NewKillSwitch(limits LossLimits, path string) (*KillSwitch, error) {
+	k := &KillSwitch{Limits: limits, path: path}
+	if path == "" {
+		return k, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.tripped = &TripError{}
+	if err := json.Unmarshal(data, k.tripped); err != nil {
+		k.tripped.Reason = "unreadable latch file " + path
+	}
+
+	return k, nil
+}
+
+// Error describes the breach
+func (err *TripError) Error() string {
+	return fmt.Sprintf("risk: kill switch tripped at %s: %s", err.Time.Format(time.RFC3339), err.Reason)
+}
+
+// Is matches ErrTripped
+func (err *TripError) Is(target error) bool {
+	return target == ErrTripped
+}
+
+// Check trips the switch if session or daily P&L, including open P&L,
+// breaches a limit at now. It returns the TripError while tripped.
+func (k *KillSwitch) Check(session, daily float64, now time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.tripped != nil {
+		return k.tripped
+	}
+
+	k.peak = math.Max(k.peak, session)
+	var reason string
+	switch {
+	case k.Limits.Daily > 0 && daily <= -k.Limits.Daily:
+		reason = fmt.Sprintf("daily P&L %.4f breached loss limit %.4f", daily, k.Limits.Daily)
+	case k.Limits.Session > 0 && session <= -k.Limits.Session:
+		reason = fmt.Sprintf("session P&L %.4f breached loss limit %.4f", session, k.Limits.Session)
+	case k.Limits.Drawdown > 0 && k.peak-session >= k.Limits.Drawdown:
+		reason = fmt.Sprintf("drawdown %.4f from peak %.4f breached limit %.4f", k.peak-session, k.peak, k.Limits.Drawdown)
+	default:
+		return nil
+	}
+	k.tripped = &TripError{now, reason}
+
+	if k.path != "" {
+		data, _ := json.Marshal(k.tripped)
+		if err := os.WriteFile(k.path, data, 0666); err != nil {
+			return fmt.Errorf("%w, latch not saved: %s", k.tripped, err)
+		}
+	}
+
+	return k.tripped
+}
+
+// Tripped returns the TripError if the switch is tripped, nil if not
+func (k *KillSwitch) Tripped() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.tripped == nil {
+		return nil
+	}
+
+	return k.tripped
+}
+
+// Reset releases a tripped switch, removing its latch file
+func (k *KillSwitch) Reset() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.path != "" {
+		if err := os.Remove(k.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	k.tripped = nil
+	k.peak = 0
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package risk
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKillSwitch(t *testing.T) {
+	now := time.Date(2015, 10, 8, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "bitmm.kill")
+	k, err := NewKillSwitch(LossLimits{Daily: 100, Session: 50, Drawdown: 30}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the limits
+	for _, pl := range []float64{10, 40, 15} {
+		if err := k.Check(pl, pl-60, now); err != nil {
+			t.Fatalf("Unexpected trip at %.2f: %s", pl, err)
+		}
+	}
+
+	// 30 down from the peak of 40
+	err = k.Check(10, -50, now)
+	var trip *TripError
+	if !errors.As(err, &trip) || !errors.Is(err, ErrTripped) || !trip.Time.Equal(now) {
+		t.Fatalf("Expected drawdown trip, got %v", err)
+	}
+
+	// Latched, even after recovering and restarting
+	if err := k.Check(100, 100, now); err == nil {
+		t.Fatal("Expected switch to stay tripped")
+	}
+	restarted, err := NewKillSwitch(k.Limits, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Tripped(); !errors.As(err, &trip) || trip.Reason != k.tripped.Reason {
+		t.Fatalf("Expected latched trip, got %v", err)
+	}
+
+	if err := restarted.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted, _ = NewKillSwitch(k.Limits, path); restarted.Tripped() != nil {
+		t.Fatal("Expected reset to remove the latch")
+	}
+}
+
+func TestLossLimits(t *testing.T) {
+	for _, test := range []struct {
+		session, daily float64
+		tripped        bool
+	}{
+		{-49, -99, false},
+		{-50, 0, true},
+		{0, -100, true},
+	} {
+		k, _ := NewKillSwitch(LossLimits{Daily: 100, Session: 50}, "")
+		if err := k.Check(test.session, test.daily, time.Now()); (err != nil) != test.tripped {
+			t.Errorf("Session %.2f, daily %.2f: got %v", test.session, test.daily, err)
+		}
+	}
+
+	// No limits never trip
+	k, _ := NewKillSwitch(LossLimits{}, "")
+	if err := k.Check(-1e9, -1e9, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,148 @@
+// Pre-trade checks on outgoing orders
+
+package risk
+
+import (
+	"bitmm/bitfinex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Tolerance for rounding when comparing amounts with limits
+const epsilon = 1e-9
+
+// OrderLimits bound the orders sent to the exchange, each unchecked if 0
+type OrderLimits struct {
+	MaxSize       float64 // Amount of an order
+	MaxNotional   float64 // Amount times price of an order
+	Collar        float64 // Fraction a limit price may be from theo and the last trade
+	MaxOpenOrders int     // Orders live at once
+	MaxPosition   float64 // Position if every open order filled
+	MaxRate       int     // Orders sent per minute
+}
+
+// Exposure is the market and account state orders are checked against
+type Exposure struct {
+	Theo       float64 // Theoretical value, not collared if 0
+	Last       float64 // Last trade price, not collared if 0
+	Position   float64 // Current position, positive when long
+	OpenOrders int     // Orders live on the exchange
+	OpenBuys   float64 // Amount of the open buy orders
+	OpenSells  float64 // Amount of the open sell orders
+}
+
+// RejectError reports an order breaching a limit
+type RejectError struct {
+	Order  bitfinex.OrderParams
+	Reason string
+}
+
+// PreTrade checks orders against limits before they are sent. Safe for
+// concurrent use.
+type PreTrade struct {
+	Limits OrderLimits
+
+	mu   sync.Mutex
+	sent []time.Time // When orders accepted in the last minute were sent
+}
+
+// NewPreTrade returns pre-trade checks with limits
+func NewPreTrade(limits OrderLimits) *PreTrade {
+	return &PreTrade{Limits: limits}
+}
+
+// Error describes the order and the limit it breached
+func (err *RejectError) Error() string {
+	o := err.Order
+	return fmt.Sprintf("risk: rejected %s %s %.4f %s @ %.4f: %s", o.Type, o.Side, o.Amount, o.Symbol, o.Price, err.Reason)
+}
+
+// Check returns the orders within the limits, in order, and a RejectError for
+// each of the rest. Accepted orders count as sent at now and as open for the
+// orders after them.
+func (p *PreTrade) Check(orders []bitfinex.OrderParams, exposure Exposure, now time.Time) (accepted []bitfinex.OrderParams, rejected []error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Forget orders sent more than a minute ago
+	recent := p.sent[:0]
+	for _, t := range p.sent {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	p.sent = recent
+
+	for _, order := range orders {
+		if reason := p.reason(order, exposure); reason != "" {
+			rejected = append(rejected, &RejectError{order, reason})
+			continue
+		}
+		accepted = append(accepted, order)
+		p.sent = append(p.sent, now)
+		exposure.OpenOrders++
+		if order.Side == "buy" {
+			exposure.OpenBuys += order.Amount
+		} else {
+			exposure.OpenSells += order.Amount
+		}
+	}
+
+	return accepted, rejected
+}
+
+// reason returns why order breaches a limit, empty if it does not
+func (p *PreTrade) reason(order bitfinex.OrderParams, exposure Exposure) string {
+	l := p.Limits
+
+	if order.Amount <= 0 {
+		return fmt.Sprintf("amount %.4f not positive", order.Amount)
+	}
+	if order.Side != "buy" && order.Side != "sell" {
+		return fmt.Sprintf("unknown side %q", order.Side)
+	}
+	if l.MaxSize > 0 && order.Amount > l.MaxSize+epsilon {
+		return fmt.Sprintf("amount %.4f over max order size %.4f", order.Amount, l.MaxSize)
+	}
+
+	// Market orders are valued at the last trade or theo
+	price := order.Price
+	if order.Type == "market" {
+		price = exposure.Last
+		if price == 0 {
+			price = exposure.Theo
+		}
+	} else if l.Collar > 0 {
+		for _, ref := range []struct {
+			name  string
+			price float64
+		}{{"theo", exposure.Theo}, {"last trade", exposure.Last}} {
+			if ref.price > 0 && math.Abs(order.Price-ref.price) > l.Collar*ref.price {
+				return fmt.Sprintf("price more than %.2f%% from %s %.4f", 100*l.Collar, ref.name, ref.price)
+			}
+		}
+	}
+	if l.MaxNotional > 0 && order.Amount*price > l.MaxNotional {
+		return fmt.Sprintf("notional %.4f over max %.4f", order.Amount*price, l.MaxNotional)
+	}
+
+	if l.MaxOpenOrders > 0 && exposure.OpenOrders >= l.MaxOpenOrders {
+		return fmt.Sprintf("%d orders open, max %d", exposure.OpenOrders, l.MaxOpenOrders)
+	}
+	if l.MaxPosition > 0 {
+		if order.Side == "buy" {
+			if projected := exposure.Position + exposure.OpenBuys + order.Amount; projected > l.MaxPosition+epsilon {
+				return fmt.Sprintf("position %.4f if open buys fill, max %.4f", projected, l.MaxPosition)
+			}
+		} else if projected := exposure.Position - exposure.OpenSells - order.Amount; projected < -l.MaxPosition-epsilon {
+			return fmt.Sprintf("position %.4f if open sells fill, max %.4f", projected, -l.MaxPosition)
+		}
+	}
+	if l.MaxRate > 0 && len(p.sent) >= l.MaxRate {
+		return fmt.Sprintf("%d orders sent in the last minute, max %d", len(p.sent), l.MaxRate)
+	}
+
+	return ""
+}
@@ -0,0 +1,71 @@
+package risk
+
+import (
+	"bitmm/bitfinex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreTrade(t *testing.T) {
+	p := NewPreTrade(OrderLimits{MaxSize: 5, MaxNotional: 1000, Collar: .05, MaxOpenOrders: 3, MaxPosition: 5})
+	exposure := Exposure{Theo: 250, Last: 245, Position: 2, OpenOrders: 1, OpenSells: 1}
+	order := func(amount, price float64, side string) bitfinex.OrderParams {
+		return bitfinex.OrderParams{"btcusd", amount, price, "bitfinex", side, "limit"}
+	}
+
+	for _, test := range []struct {
+		order  bitfinex.OrderParams
+		reason string
+	}{
+		{order(6, 250, "sell"), "max order size"},
+		{order(4.5, 240, "sell"), "notional"},
+		{order(1, 264, "sell"), "from theo"},
+		{order(1, 258, "sell"), "from last trade"},
+		{order(3.5, 240, "buy"), "position 5.5000"},
+		{order(0, 250, "buy"), "not positive"},
+		{order(1, 250, "short"), "unknown side"},
+	} {
+		accepted, rejected := p.Check([]bitfinex.OrderParams{test.order}, exposure, time.Now())
+		var reject *RejectError
+		if len(accepted) != 0 || len(rejected) != 1 || !errors.As(rejected[0], &reject) ||
+			!strings.Contains(reject.Reason, test.reason) {
+			t.Errorf("%+v: expected rejection for %s, got %v", test.order, test.reason, rejected)
+		}
+	}
+
+	// Accepted orders count towards the open orders and position of the rest
+	accepted, rejected := p.Check([]bitfinex.OrderParams{
+		order(3, 245, "buy"),
+		order(1, 245, "buy"),
+		order(3, 255, "sell"),
+		order(1, 255, "sell"),
+	}, exposure, time.Now())
+	if len(accepted) != 2 || len(rejected) != 2 || !strings.Contains(rejected[0].Error(), "position") ||
+		!strings.Contains(rejected[1].Error(), "orders open") {
+		t.Fatalf("Unexpected checks %+v %v", accepted, rejected)
+	}
+}
+
+func TestOrderRate(t *testing.T) {
+	p := NewPreTrade(OrderLimits{MaxRate: 3})
+	now := time.Date(2015, 10, 8, 12, 0, 0, 0, time.UTC)
+	buy := bitfinex.OrderParams{"btcusd", 1, 250, "bitfinex", "buy", "limit"}
+
+	accepted, _ := p.Check([]bitfinex.OrderParams{buy, buy}, Exposure{}, now)
+	if len(accepted) != 2 {
+		t.Fatalf("Expected 2 accepted, got %d", len(accepted))
+	}
+	now = now.Add(30 * time.Second)
+	accepted, rejected := p.Check([]bitfinex.OrderParams{buy, buy}, Exposure{}, now)
+	if len(accepted) != 1 || len(rejected) != 1 || !strings.Contains(rejected[0].Error(), "last minute") {
+		t.Fatalf("Expected rate limit, got %+v %v", accepted, rejected)
+	}
+
+	// The first orders age out of the window
+	now = now.Add(31 * time.Second)
+	if accepted, _ := p.Check([]bitfinex.OrderParams{buy, buy, buy}, Exposure{}, now); len(accepted) != 2 {
+		t.Fatalf("Expected 2 accepted, got %d", len(accepted))
+	}
+}
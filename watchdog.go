@@ -0,0 +1,86 @@
+// Cancel all orders when the main loop, or the whole process, stops responding
+
+package main
+
+import (
+	"bitmm/bitfinex"
+	"bitmm/exchange"
+	"bitmm/quotes"
+	"bitmm/watchdog"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Watch the heartbeat file of a bitmm process, cancelling all orders with a
+// client of our own if it goes stale, until input is received
+func runWatchdog() error {
+	if cfg.Sec.HeartbeatFile == "" || cfg.Sec.WatchdogTimeout <= 0 {
+		return errors.New("watchdog needs heartbeatFile and watchdogTimeout set")
+	}
+
+	// A key of its own keeps its nonces apart from the watched process's.
+	// Sharing its key, nonces continue from those it persisted when cancelling.
+	key, secret := os.Getenv("WATCHDOG_KEY"), os.Getenv("WATCHDOG_SECRET")
+	shared := key == ""
+	if shared {
+		if cfg.Sec.NonceFile == "" {
+			return errors.New("watchdog needs WATCHDOG_KEY, or nonceFile set to share BITFINEX_KEY")
+		}
+		key, secret = os.Getenv("BITFINEX_KEY"), os.Getenv("BITFINEX_SECRET")
+	}
+	retry := bitfinex.Retry(bitfinex.RetryPolicy{
+		MaxAttempts: cfg.Sec.Retries,
+		BaseDelay:   time.Duration(cfg.Sec.RetryDelay * float64(time.Second)),
+		MaxDelay:    time.Duration(cfg.Sec.Timeout) * time.Second,
+		Jitter:      0.5,
+	})
+
+	timeout := time.Duration(cfg.Sec.WatchdogTimeout) * time.Second
+	dog := watchdog.New(timeout, "", func() bool {
+		nonce := bitfinex.NewNonce()
+		if shared {
+			var err error
+			if nonce, err = bitfinex.NewFileNonce(cfg.Sec.NonceFile); err != nil {
+				log.Printf("Watchdog Nonce Error: %s\n", err)
+				return false
+			}
+		}
+		bfx := bitfinex.New(key, secret, bitfinex.NonceSource(nonce), retry)
+		return cancelStalled(bfx, "heartbeat in "+cfg.Sec.HeartbeatFile+" stopped")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dog.Watch(ctx, cfg.Sec.HeartbeatFile)
+
+	inputChan := make(chan string)
+	go checkStdin(inputChan)
+	notifySignals(inputChan, make(chan os.Signal, 1))
+	fmt.Printf("\nWatching %s, press enter to stop...\n", cfg.Sec.HeartbeatFile)
+	<-inputChan
+
+	return nil
+}
+
+// Cancel all orders with c, bypassing the quote manager in case whatever
+// stalled holds it, and report whether the exchange confirmed it
+func cancelStalled(c exchange.Trading, reason string) bool {
+	log.Printf("Watchdog: %s, cancelling all orders\n", reason)
+	fmt.Printf("\nWATCHDOG: %s, cancelling all orders\n", reason)
+	ctx, cancel := apiContext()
+	defer cancel()
+
+	cancelled, err := c.CancelAllContext(ctx)
+	if err == nil && !cancelled {
+		err = quotes.ErrNotCancelled
+	}
+	if err != nil {
+		log.Printf("Watchdog CancelAll Error: %s\n", err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,148 @@
+// Dead-man's switch acting when the strategy stops sending heartbeats
+
+package watchdog
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watchdog calls its action, e.g. cancelling all orders, once a heartbeat is
+// overdue by more than Timeout. The action is retried until it succeeds, then
+// not called again until heartbeats resume and stop again. Safe for
+// concurrent use.
+type Watchdog struct {
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	action  func() bool
+	path    string           // Heartbeat file for another process to watch, none if empty
+	last    time.Time        // Last heartbeat
+	fired   time.Time        // Last heartbeat when the action last succeeded
+	written time.Time        // When the heartbeat file was last written
+	stopped bool             // Stopped, never to act again
+	now     func() time.Time // Clock, replaced in tests
+}
+
+// New returns a watchdog calling action, which reports whether it
+// succeeded, when heartbeats stop for timeout. Heartbeats are written to the
+// file at path, if not empty, at most once a second.
+func New(timeout time.Duration, path string, action func() bool) *Watchdog {
+	w := &Watchdog{Timeout: timeout, action: action, path: path, now: time.Now}
+	w.last = w.now()
+
+	return w
+}
+
+// Beat records a heartbeat, returning any error writing the heartbeat file
+func (w *Watchdog) Beat() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	w.last = now
+	if w.path == "" || now.Sub(w.written) < time.Second {
+		return nil
+	}
+	w.written = now
+
+	return WriteHeartbeat(w.path, now)
+}
+
+// Check calls the action if the heartbeat is overdue and the action hasn't
+// yet succeeded for this stall, and reports whether the heartbeat is overdue
+func (w *Watchdog) Check() bool {
+	w.mu.Lock()
+	last := w.last
+	stalled := !w.stopped && w.now().Sub(last) > w.Timeout
+	act := stalled && !w.fired.Equal(last)
+	w.mu.Unlock()
+
+	// Act unlocked so heartbeats aren't held up
+	if act && w.action() {
+		w.mu.Lock()
+		w.fired = last
+		w.mu.Unlock()
+	}
+
+	return stalled
+}
+
+// Run checks the heartbeat four times per timeout until ctx is done
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Check()
+		}
+	}
+}
+
+// Watch takes heartbeats from the file at path, written by another process's
+// watchdog, and checks them four times per timeout until ctx is done. A
+// missing file means the process is not running or stopped cleanly.
+func (w *Watchdog) Watch(ctx context.Context, path string) {
+	ticker := time.NewTicker(w.Timeout / 4)
+	defer ticker.Stop()
+	for {
+		beat, err := ReadHeartbeat(path)
+		w.mu.Lock()
+		if os.IsNotExist(err) {
+			w.last = w.now()
+		} else if err == nil && beat.After(w.last) {
+			w.last = beat
+		}
+		w.mu.Unlock()
+		w.Check()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the watchdog acting and removes its heartbeat file, telling any
+// process watching it that the strategy stopped cleanly
+func (w *Watchdog) Stop() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	if w.path == "" {
+		return nil
+	}
+	if err := os.Remove(w.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// WriteHeartbeat writes t to the heartbeat file at path, replacing it atomically
+func WriteHeartbeat(path string, t time.Time) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(t.UTC().Format(time.RFC3339Nano)+"\n"), 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// ReadHeartbeat returns the time in the heartbeat file at path
+func ReadHeartbeat(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+}
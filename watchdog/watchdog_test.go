@@ -0,0 +1,88 @@
+package watchdog
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	now := time.Date(2015, 10, 8, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "bitmm.heartbeat")
+	calls, succeed := 0, false
+	w := New(10*time.Second, path, func() bool {
+		calls++
+		return succeed
+	})
+	w.now = func() time.Time { return now }
+	w.last = now
+
+	if err := w.Beat(); err != nil {
+		t.Fatal(err)
+	}
+	if beat, err := ReadHeartbeat(path); err != nil || !beat.Equal(now) {
+		t.Fatalf("Unexpected heartbeat %v %v", beat, err)
+	}
+	now = now.Add(10 * time.Second)
+	if w.Check() || calls != 0 {
+		t.Fatal("Expected no stall yet")
+	}
+
+	// The action is retried until it succeeds, then not repeated
+	now = now.Add(time.Second)
+	w.Check()
+	succeed = true
+	w.Check()
+	w.Check()
+	if !w.Check() || calls != 2 {
+		t.Fatalf("Expected 2 calls, got %d", calls)
+	}
+
+	// Heartbeats re-arm it
+	w.Beat()
+	now = now.Add(11 * time.Second)
+	if !w.Check() || calls != 3 {
+		t.Fatalf("Expected 3 calls, got %d", calls)
+	}
+
+	// Stopping removes the heartbeat file
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected heartbeat file removed")
+	}
+	now = now.Add(time.Minute)
+	if w.Check() || calls != 3 {
+		t.Fatal("Expected stopped watchdog not to act")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmm.heartbeat")
+	fired := make(chan bool, 1)
+	w := New(40*time.Millisecond, "", func() bool {
+		fired <- true
+		return true
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// No heartbeat file, nothing to watch
+	go w.Watch(ctx, path)
+	select {
+	case <-fired:
+		t.Fatal("Unexpected action without heartbeat file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A heartbeat left stale
+	WriteHeartbeat(path, time.Now())
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected action on stale heartbeat")
+	}
+}
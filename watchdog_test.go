@@ -0,0 +1,22 @@
+package main
+
+import (
+	"bitmm/watchdog"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCancelStalled(t *testing.T) {
+	a := crashedSession(t, orphansCancel)
+	dog := watchdog.New(time.Millisecond, "", func() bool {
+		return cancelStalled(a, "main loop stalled")
+	})
+	time.Sleep(2 * time.Millisecond)
+	if !dog.Check() {
+		t.Fatal("Expected the loop stalled")
+	}
+	if orders, _ := a.ActiveOrdersContext(context.Background()); len(orders) != 0 {
+		t.Fatalf("Expected orders cancelled, got %+v", orders)
+	}
+}